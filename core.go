@@ -5,73 +5,102 @@ import (
 	"bufio"
 	"fmt"
 	"gincgcode/gcode"
+	"io"
 	"math"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/adrianre12/logl"
 )
 
-func ReadFile(fileName string) *gcode.Blocks {
+func ReadFile(fileName string, lenient bool, expand bool) *gcode.Blocks {
 	fileIn, err := os.Open(fileName)
 	if err != nil {
 		logl.Fatalf("Failed to open file: %s", err)
 	}
 	defer fileIn.Close()
 
-	scanner := bufio.NewScanner(fileIn)
-	blocks := make(gcode.Blocks, 0)
-
-	for scanner.Scan() {
-		txt := strings.TrimSpace(scanner.Text())
-		if len(txt) == 0 { // ignore blank lines
-			continue
-		}
-
-		block, err := gcode.ParseLine(txt)
+	reader := gcode.NewReader(fileIn)
+	reader.Lenient = lenient
+	reader.Expand = expand
+	blocks, parseErrors, err := reader.ReadAll()
+	if err != nil {
+		logl.Fatalf("Failed to read file: %s", err)
+	}
+	ReportParse(reader.Unrecognised, parseErrors)
+	if blocks.HasSubprogramCalls() {
+		expanded, calls, err := blocks.ExpandSubprograms()
 		if err != nil {
-			logl.Fatalf("Failed to parse '%s' %s", txt, err)
+			logl.Fatalf("Failed to expand subprograms: %s", err)
 		}
-		blocks = append(blocks, block)
+		logl.Infof("Expanded %d subprogram calls into %d blocks", calls, len(expanded))
+		blocks = expanded
 	}
-
-	if scanner.Err() != nil {
-		logl.Fatalf("Failed to read file: %s", scanner.Err())
+	if blocks.HasCannedCycles() {
+		expanded, err := blocks.ExpandCycles()
+		if err != nil {
+			logl.Fatalf("Failed to expand canned cycles: %s", err)
+		}
+		logl.Infof("Expanded canned cycles into %d blocks", len(expanded))
+		blocks = expanded
 	}
 	logl.Debugf("loaded %d blocks", len(blocks))
 	return &blocks
 }
 
-func OutputBlock(writer *bufio.Writer, block *gcode.Block, pretty bool) {
-	writer.WriteString(block.String(true, pretty))
+// Warns about the unrecognised words passed through and fails if any line failed to parse.
+func ReportParse(unrecognised map[string]int, parseErrors []*gcode.ParseError) {
+	words := make([]string, 0, len(unrecognised))
+	for word := range unrecognised {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	for _, word := range words {
+		logl.Warnf("Unrecognised word %s passed through %d times", word, unrecognised[word])
+	}
+	for _, parseError := range parseErrors {
+		logl.Errorf("Failed to parse %s", parseError)
+	}
+	if len(parseErrors) > 0 {
+		logl.Fatalf("%d lines failed to parse", len(parseErrors))
+	}
 }
 
-func OutputBlocks(writer *bufio.Writer, blocks gcode.Blocks, pretty bool) {
+// Writes the block, followed by the line number of its source if info.SourceLines is set.
+func OutputBlock(writer *bufio.Writer, block *gcode.Block, info *gcode.Info) {
+	if !info.SourceLines || block.Line == 0 {
+		writer.WriteString(block.String(true, info.Pretty))
+		return
+	}
+	writer.WriteString(fmt.Sprintf("%s ;line %d\n", strings.TrimRight(block.String(false, info.Pretty), " "), block.Line))
+}
+
+func OutputBlocks(writer *bufio.Writer, blocks gcode.Blocks, info *gcode.Info) {
 	for _, block := range blocks {
-		OutputBlock(writer, block, pretty)
+		OutputBlock(writer, block, info)
 	}
 }
 
 type Current struct {
-	Y        float32
-	Z        float32
+	gcode.State
 	LastPass int
 }
 
 func (c *Current) Update(block gcode.Block) {
-	if block.Y != nil && (*block.Y).Value != c.Y {
-		c.Y = (*block.Y).Value
-	}
-	if block.Z != nil && (*block.Z).Value != c.Z {
-		c.Z = (*block.Z).Value
-	}
+	c.State.Update(&block)
 	if block.IsClamped { //if it is clamped then LastPass is valid
 		c.LastPass = block.LastPass
 	}
 }
 
 func NewCurrent() Current {
-	return Current{Y: float32(math.MaxFloat32), Z: float32(math.MaxFloat32)}
+	return Current{State: gcode.NewState()}
+}
+
+// Returns the skip height in the frame of the current position.
+func skipHeight(info *gcode.Info, current *Current) float64 {
+	return info.Top + info.SkipHeight - info.Shift(&current.State).Z
 }
 
 func TernaryString(condition bool, strTrue string, strFalse string) string {
@@ -83,109 +112,208 @@ func TernaryString(condition bool, strTrue string, strFalse string) string {
 
 func Process(writer *bufio.Writer, info gcode.Info) {
 	passes := info.Passes() // calculate passes
-	logl.Infof("Passes=%d", passes)
+	LogPasses(&info, passes)
+	data := info.Data.SplitHelices(&info).SplitAlongSurface(&info) // helical arcs and moves beside the surface are clamped in pieces
 
 	for pass := 1; pass <= passes; pass++ {
 		logl.Debugf("======================== Pass %d =============================", pass)
-		writer.WriteString(fmt.Sprintf(";Pass %d\n", pass))
+		writer.WriteString(fmt.Sprintf(";Pass %d depth %.3f\n", pass, info.PassDepth(pass)))
 
 		if pass == passes { //last pass finish cut
-			OutputBlocks(writer, info.Data, info.Pretty)
+			OutputBlocks(writer, info.Data, &info)
 			continue
 		}
 
-		current := NewCurrent() //current tool position
-		last := NewCurrent()
-		var lastBlock gcode.Block
-		lastBlock.Init()
-
-		safeHeight := false
 		index := 0
-		for index < len(info.Data) { //blocks
-			block := info.Data[index]
-			logl.Debugf("%d %s", index, block.String(false, true))
+		ProcessPass(writer, &info, pass, func() *gcode.Block {
+			if index == len(data) {
+				return nil
+			}
+			index++
+			return data[index-1]
+		})
+	}
+}
 
-			last = current
-			clampedBlock := block.Copy() //copy the block
-			clampedBlock.ToStepZ(&info, pass)
-			current.Update(clampedBlock)
+// Writes a roughing pass of the data blocks returned by next, which returns nil after the last one.
+func ProcessPass(writer *bufio.Writer, info *gcode.Info, pass int, next func() *gcode.Block) {
+	current := NewCurrent() //current tool position
+	last := NewCurrent()
+	var lastBlock gcode.Block
+	lastBlock.Init()
+
+	safeHeight := false
+	scan := info.ScanDirection()
+	var skipState gcode.State      // of lastBlock
+	cutFrom := gcode.NewState()    // last position cut to
+	cut := func(to *gcode.State) { // the stock along a move
+		if info.Stock != nil && cutFrom.KnownX && cutFrom.KnownY && cutFrom.KnownZ && to.KnownX && to.KnownY && to.KnownZ {
+			info.CutStock(&cutFrom, to)
+		}
+		cutFrom = *to
+	}
+	index := 0
+	// one block ahead to know the last block
+	following := next()
+	for following != nil { //blocks
+		block := following
+		following = next()
+		logl.Debugf("%d %s", index, block.String(false, true))
+
+		last = current
+		clampedBlock := block.Copy() //copy the block
+		clampedBlock.ToStepZ(info, pass)
+		if block.Z == nil && clampedBlock.Z != nil && current.KnownZ && gcode.Near(clampedBlock.Z.Value, current.Position.Z, info.Tolerance) {
+			unchanged := block.Copy() // the Z given for the surface is not needed
+			unchanged.IsClamped = true
+			unchanged.LastPass = clampedBlock.LastPass
+			clampedBlock = unchanged
+		}
+		current.Update(clampedBlock)
+		known := last.KnownX && last.KnownY && last.KnownZ && current.KnownX && current.KnownY && current.KnownZ
+		air := info.Stock != nil && known && clampedBlock.IsMove() && !clampedBlock.IsArc() && info.Engagement(&last.State, &current.State) <= info.RestThreshold
+		if air { // no stock left to cut, so the tool rises to the skip height as over an earlier pass
+			current.LastPass = pass - 1
+		}
 
-			if clampedBlock.IsClamped {
-				logl.Debugf("Z clamped to %.3f", (*clampedBlock.Z).Value)
-			}
-			logl.Debugf("Current Y=%.3f Z=%.3f LastPass = %d", current.Y, current.Z, current.LastPass)
+		if clampedBlock.IsClamped {
+			logl.Debugf("Z clamped to %.3f", current.Position.Z)
+		}
+		logl.Debugf("Current X=%.3f Y=%.3f Z=%.3f LastPass = %d", current.Position.X, current.Position.Y, current.Position.Z, current.LastPass)
 
-			if info.FeedRate > 0 && clampedBlock.F != nil {
-				clampedBlock.SetF(info.FeedRate)
-			}
+		if info.FeedRate > 0 && clampedBlock.F != nil && !clampedBlock.State.InverseTime { // G93 F is not a rate
+			clampedBlock.SetF(info.FeedRate)
+		}
 
-			skip := false
-			if clampedBlock.NoChangeZ(last.Z) {
+		skip := false
+		if current.SameZ(&last.State, info.Tolerance) {
+			skip = true
+		} else {
+			if safeHeight && current.LastPass < pass {
 				skip = true
+			}
+		}
+		skip = skip && current.AlongScan(&last.State, scan, info.Tolerance) && !clampedBlock.IsArc() // arcs cannot be merged
+		skip = skip || air
+		skip = skip && current.Aux.Near(&last.Aux, info.Tolerance) // nor rotations
+		skip = skip && clampedBlock.IsMove()                       // dwells, coolant and other words pass through
+		logl.Debugf("Skip = %t", skip)
+
+		if skip {
+			logl.Debugf("skip %d", index)
+			index++
+			if air && lastBlock.IsSkip && lastBlock.LastPass >= pass { // end the merged moves before rising
+				logl.Debug("Output lastBlock before cutting air")
+				OutputBlock(writer, &lastBlock, info)
+				cut(&skipState)
+				lastBlock.Init()
+			}
+			if following == nil {
+				logl.Debug("Output lastBlock as it is end of data")
+				OutputBlock(writer, &clampedBlock, info)
 			} else {
-				if safeHeight && current.LastPass < pass {
-					skip = true
+				if logl.GetLevel() == logl.DEBUG {
+					writer.WriteString(";skip ")
+					OutputBlock(writer, &clampedBlock, info)
 				}
 			}
-			skip = skip && clampedBlock.NoChangeY(last.Y)
-			logl.Debugf("Skip = %t", skip)
-
-			if skip {
-				logl.Debugf("skip %d", index)
-				index++
-				if index == len(info.Data) {
-					logl.Debug("Output lastBlock as it is end of data")
-					OutputBlock(writer, &clampedBlock, info.Pretty)
+			if !lastBlock.IsSkip && current.LastPass < pass { //starting to skip, move to skip height
+				logl.Debug("Starting skip move to skip height")
+				writer.WriteString(fmt.Sprintf("G00 Z%.3f%s\n", skipHeight(info, &current), TernaryString(info.Pretty, " ;fast to skip height", "")))
+				safeHeight = true
+			}
+			lifted := lastBlock.IsSkip && lastBlock.LastPass < pass
+			lastBlock = clampedBlock.Copy()
+			lastBlock.LastPass = current.LastPass
+			if lifted { // still at the skip height
+				lastBlock.LastPass = pass - 1
+			}
+			lastBlock.IsSkip = true
+			skipState = current.State
+
+		} else { // Z moved or the move left the scan line
+			if lastBlock.IsSkip {
+				if lastBlock.LastPass < pass {
+					logl.Debug("Output fast lastBlock and slow to depth")
+					height := skipHeight(info, &last)
+					lastBlock.SetZ(height)
+					lastBlock.SetG(0)
+					OutputBlock(writer, &lastBlock, info)
+					enter(writer, info, &last.State, &current.State, height, &clampedBlock)
+					safeHeight = false
+					cutFrom = skipState
 				} else {
-					if logl.GetLevel() == logl.DEBUG {
-						writer.WriteString(";skip ")
-						OutputBlock(writer, &clampedBlock, info.Pretty)
-					}
-				}
-				if !lastBlock.IsSkip && current.LastPass < pass { //starting to skip, move to skip height
-					logl.Debug("Starting skip move to skip height")
-					writer.WriteString(fmt.Sprintf("G00 Z%.3f%s\n", info.SkipHeight, TernaryString(info.Pretty, " ;fast to skip height", "")))
-					safeHeight = true
-				}
-				lastBlock = clampedBlock.Copy()
-				lastBlock.LastPass = current.LastPass
-				lastBlock.IsSkip = true
-
-			} else { // Y or Z moved
-				if lastBlock.IsSkip {
-					if lastBlock.LastPass < pass {
-						logl.Debug("Output fast lastBlock and slow to depth")
-						lastZ := last.Z
-						lastBlock.SetZ(info.SkipHeight)
-						lastBlock.SetG(0)
-						OutputBlock(writer, &lastBlock, info.Pretty)
-						writer.WriteString(fmt.Sprintf("G01 Z%.3f%s\n", lastZ, TernaryString(info.Pretty, " ;slow to depth", "")))
-						safeHeight = false
-					} else {
-						logl.Debug("Output lastBlock")
-						OutputBlock(writer, &lastBlock, info.Pretty)
-					}
-					lastBlock.Init()
-				}
-
-				logl.Debugf("Output %d", index)
-				OutputBlock(writer, &clampedBlock, info.Pretty)
-				if lastBlock.IsSkip && lastBlock.LastPass < pass { //point is from shallower pass
-					writer.WriteString(fmt.Sprintf("G00 Z%.3f%s\n", info.SkipHeight, TernaryString(info.Pretty, " ;fast to skip height after change", "")))
-					safeHeight = true
+					logl.Debug("Output lastBlock")
+					OutputBlock(writer, &lastBlock, info)
+					cut(&skipState)
 				}
-				index++
+				lastBlock.Init()
 			}
 
+			logl.Debugf("Output %d", index)
+			OutputBlock(writer, &clampedBlock, info)
+			if clampedBlock.IsMove() {
+				cut(&current.State)
+			}
+			if lastBlock.IsSkip && lastBlock.LastPass < pass { //point is from shallower pass
+				writer.WriteString(fmt.Sprintf("G00 Z%.3f%s\n", skipHeight(info, &current), TernaryString(info.Pretty, " ;fast to skip height after change", "")))
+				safeHeight = true
+			}
+			index++
 		}
+
 	}
+}
 
+// Writes the entry from the skip height at Z height down to the position of from, before the block moving to to.
+// If the entry changes the feed or the motion, the feed of the cuts or the G word of the motion is set on the block.
+func enter(writer *bufio.Writer, info *gcode.Info, from *gcode.State, to *gcode.State, height float64, block *gcode.Block) {
+	feed := info.CutFeed(from)
+	entryFeed := feed
+	if info.EntryFeed > 0 && !from.InverseTime { // G93 F is not a rate
+		entryFeed = info.EntryFeed
+	}
+	start := *from
+	start.Feed = feed // of the output
+	moves := info.EntryMoves(&start, to, height, entryFeed)
+	if moves != nil {
+		logl.Debugf("%s entry in %d moves", info.Entry, len(moves))
+		OutputBlocks(writer, moves, info)
+	} else {
+		word := ""
+		if entryFeed != feed {
+			word = fmt.Sprintf(" F%g", entryFeed)
+		}
+		writer.WriteString(fmt.Sprintf("G01 Z%.3f%s%s\n", from.Position.Z, word, TernaryString(info.Pretty, " ;slow to depth", "")))
+	}
+	if entryFeed != feed && block.F == nil {
+		block.SetF(feed)
+	}
+	left := gcode.Linear // by the entry
+	if moves != nil {
+		left = moves[len(moves)-1].State.Motion
+	}
+	if to.Motion != left && block.G == nil { // the motion of the block is not modal after the entry
+		block.SetG(to.Motion.Code())
+	}
 }
 
-func Realign(info *gcode.Info, alignment string) {
+// Realigns the data of all segments by the same offset so they stay aligned to each other.
+func Realign(segments []gcode.Info, alignment string) {
+	var bounds gcode.Info // of all the segments
+	bounds.Init()
+	for _, info := range segments {
+		if len(info.Data) == 0 {
+			continue
+		}
+		bounds.X.Update(info.X.Min)
+		bounds.X.Update(info.X.Max)
+		bounds.Y.Update(info.Y.Min)
+		bounds.Y.Update(info.Y.Max)
+	}
 
-	var offsetX float32 // to be added to positions
-	var offsetY float32
+	var offsetX float64 // to be added to positions
+	var offsetY float64
 
 	switch strings.ToLower(alignment) {
 	case "none":
@@ -195,28 +323,250 @@ func Realign(info *gcode.Info, alignment string) {
 		}
 	case "corner":
 		{
-			offsetX = -info.X.Min
-			offsetY = -info.Y.Min
+			offsetX = -bounds.X.Min
+			offsetY = -bounds.Y.Min
 		}
 	case "center":
 		{
-			offsetX = -(info.X.Max + info.X.Min) / 2
-			offsetY = -(info.Y.Max + info.Y.Min) / 2
+			offsetX = -(bounds.X.Max + bounds.X.Min) / 2
+			offsetY = -(bounds.Y.Max + bounds.Y.Min) / 2
 		}
 	default:
 		{
 			logl.Fatalf("Invalid Alignment %s", alignment)
 		}
 	}
+	if offsetX == 0 && offsetY == 0 {
+		return
+	}
+
+	for i := range segments {
+		info := &segments[i]
+		for _, block := range info.Data {
+			if block.State.G92 != info.Start.G92 { // a frame set by G92 in the data moves with the blocks
+				continue
+			}
+			block.Reposition(offsetX, offsetY)
+		}
 
-	for _, block := range info.Data {
-		block.Reposition(offsetX, offsetY)
+		info.X.Min = info.X.Min + offsetX
+		info.X.Max = info.X.Max + offsetX
+		info.Y.Min = info.Y.Min + offsetY
+		info.Y.Max = info.Y.Max + offsetY
 	}
+}
 
-	info.X.Min = info.X.Min + offsetX
-	info.X.Max = info.X.Max + offsetX
-	info.Y.Min = info.Y.Min + offsetY
-	info.Y.Max = info.Y.Max + offsetY
+// True if the tool is in tools or tools is empty.
+func IsSelected(tools []int, tool int) bool {
+	if len(tools) == 0 {
+		return true
+	}
+	for _, t := range tools {
+		if t == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the roughing parameters of the command line, parameters without units are in the units of the program.
+func SetParameters(info *gcode.Info, cli *CliType) {
+	info.Increment = cli.Increment.In(info.Units)
+	info.MinCut = cli.MinCut.In(info.Units)
+	info.SkipHeight = cli.SkipHeight.In(info.Units)
+	info.Top = cli.Radius.In(info.Units)
+	if cli.Even {
+		if len(cli.Depths) > 0 || cli.DepthRatio != 1 {
+			logl.Fatal("--even cannot be combined with --depths or --depth-ratio")
+		}
+		if err := info.EvenDepths(cli.EvenCap); err != nil {
+			logl.Fatal(err.Error())
+		}
+	} else if len(cli.Depths) > 0 || cli.DepthRatio != 1 {
+		depths := make([]float64, len(cli.Depths))
+		for i, depth := range cli.Depths {
+			depths[i] = depth.In(info.Units)
+		}
+		if err := info.ScheduleDepths(depths, cli.DepthRatio); err != nil {
+			logl.Fatal(err.Error())
+		}
+	}
+	if cli.RestThreshold.Value > 0 && cli.RoughDiameter.Value <= 0 {
+		logl.Fatal("--rest-threshold needs --rough-diameter")
+	}
+	info.FeedRate = cli.Feed.In(info.Units)
+	entry, err := gcode.ParseEntry(cli.Entry)
+	if err != nil {
+		logl.Fatal(err.Error())
+	}
+	info.Entry = entry
+	if entry != gcode.Plunge && (cli.EntryAngle <= 0 || cli.EntryAngle >= 90) {
+		logl.Fatal("Entry angle must be between 0 and 90")
+	}
+	info.EntryAngle = cli.EntryAngle
+	info.HelixRadius = cli.HelixDiameter.In(info.Units) / 2
+	if info.HelixRadius == 0 {
+		info.HelixRadius = cli.ToolDiameter.In(info.Units) / 2
+	}
+	if entry == gcode.Helix && info.HelixRadius <= 0 {
+		logl.Fatal("--entry helix needs a positive --helix-diameter or --tool-diameter")
+	}
+	if entry == gcode.Helix && cli.ToolShape == "none" {
+		logl.Fatal("--entry helix needs the --tool-shape of the finish tool to find room for the helix")
+	}
+	info.EntryFeed = cli.EntryFeed.In(info.Units)
+	info.Tolerance = cli.Tolerance.In(info.Units)
+	info.Pretty = cli.Pretty
+	info.SourceLines = cli.SourceLines
+}
+
+// Maps the surface left by the data blocks returned by next, which returns nil after the last one,
+// if the shape of the tool is given.
+func MapSurface(info *gcode.Info, cli *CliType, next func() *gcode.Block) {
+	if cli.ToolShape == "none" {
+		return
+	}
+	shape, err := gcode.ParseToolShape(cli.ToolShape)
+	if err != nil {
+		logl.Fatal(err.Error())
+	}
+	tool := gcode.Tool{Shape: shape, Diameter: cli.ToolDiameter.In(info.Units), Angle: cli.ToolAngle, TipDiameter: cli.ToolTip.In(info.Units)}
+	if err := info.NewSurface(tool, cli.SurfaceCell.In(info.Units)); err != nil {
+		logl.Fatal(err.Error())
+	}
+	for block := next(); block != nil; block = next() {
+		info.CutSurface(block)
+	}
+	logl.Infof("Surface of a %s tool diameter=%.3f mapped in %dx%d cells of %.3f", shape, tool.Diameter, info.Surface.Cols, info.Surface.Rows, info.Surface.Cell)
+}
+
+// Writes the roughing of the surface with a flat end mill, with a tool change before it and one back
+// to the finish tool after it. Nothing is written and false is returned if there is nothing to rough.
+func RoughSurface(writer *bufio.Writer, info *gcode.Info, cli *CliType) bool {
+	if info.Surface == nil {
+		logl.Fatal("--rough-diameter needs the --tool-shape of the finish tool")
+	}
+	tool := gcode.Tool{Shape: gcode.FlatEnd, Diameter: cli.RoughDiameter.In(info.Units)}
+	stepover := cli.RoughStepover.In(info.Units)
+	if stepover == 0 {
+		stepover = tool.Diameter * gcode.DefaultStepover
+	}
+	blocks, err := info.RoughSurface(tool, stepover)
+	if err != nil {
+		logl.Fatal(err.Error())
+	}
+	if len(blocks) == 0 { // no stock left to rough, nor any for the rest passes
+		logl.Infof("Nothing to rough with a %.3f end mill", tool.Diameter)
+		return false
+	}
+	logl.Infof("Roughing with a %.3f end mill stepover=%.3f in %d moves", tool.Diameter, stepover, len(blocks))
+	if cli.RestThreshold.Value > 0 {
+		info.RoughStock(tool, blocks)
+		info.RestThreshold = cli.RestThreshold.In(info.Units)
+	}
+
+	writer.WriteString(fmt.Sprintf(";Roughing with a %.3f end mill\n", tool.Diameter))
+	writer.WriteString(fmt.Sprintf("G00 Z%.3f\n", info.Top+info.SkipHeight))
+	changeTool(writer, cli.RoughTool, "roughing")
+	spindle := info.Start
+	if spindle.Spindle == gcode.SpindleOff {
+		spindle.Spindle = gcode.SpindleCW
+	}
+	if spindle.Speed == 0 { // set in the data
+		spindle.Speed = info.End.Speed
+	}
+	startSpindle(writer, &spindle)
+	OutputBlocks(writer, blocks, info)
+	changeTool(writer, info.Tool, "finish")
+	if info.Start.Spindle != gcode.SpindleOff { // otherwise the data starts it
+		startSpindle(writer, &info.Start)
+	}
+	return true
+}
+
+// Writes the passes of the data that cut more than the rest threshold of the stock left by the roughing.
+// Moves that cut no more are skipped and passes that cut no more anywhere are left out.
+// open returns a function returning the data blocks one at a time, nil after the last one.
+func RestPasses(writer *bufio.Writer, info *gcode.Info, open func() func() *gcode.Block) {
+	if info.Stock == nil {
+		return
+	}
+	passes := info.Passes()
+	for pass := 1; pass < passes; pass++ { // the last pass is the finish
+		if !restPassCuts(info, pass, open()) {
+			logl.Infof("Rest pass %d depth=%.3f cuts no stock, left out", pass, info.PassDepth(pass))
+			continue
+		}
+		logl.Infof("Rest pass %d depth=%.3f", pass, info.PassDepth(pass))
+		writer.WriteString(fmt.Sprintf(";Rest pass %d depth %.3f\n", pass, info.PassDepth(pass)))
+		ProcessPass(writer, info, pass, open())
+	}
+}
+
+// True if a move of the pass cuts more than the rest threshold of the stock.
+func restPassCuts(info *gcode.Info, pass int, next func() *gcode.Block) bool {
+	current := NewCurrent()
+	for block := next(); block != nil; block = next() {
+		last := current
+		clampedBlock := block.Copy()
+		clampedBlock.ToStepZ(info, pass)
+		current.Update(clampedBlock)
+		known := last.KnownX && last.KnownY && last.KnownZ && current.KnownX && current.KnownY && current.KnownZ
+		if known && clampedBlock.IsMove() && info.Engagement(&last.State, &current.State) > info.RestThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops the spindle and changes to the tool, or pauses for a manual change if the tool number is 0.
+func changeTool(writer *bufio.Writer, tool int, name string) {
+	writer.WriteString("M05\n")
+	if tool > 0 {
+		writer.WriteString(fmt.Sprintf("T%d M06\n", tool))
+	} else {
+		writer.WriteString(fmt.Sprintf("M00 ;change to the %s tool\n", name))
+	}
+}
+
+// Starts the spindle in the direction and at the speed of the state.
+func startSpindle(writer *bufio.Writer, state *gcode.State) {
+	code := "M03"
+	if state.Spindle == gcode.SpindleCCW {
+		code = "M04"
+	}
+	if state.Speed > 0 {
+		writer.WriteString(fmt.Sprintf("%s S%g\n", code, state.Speed))
+	} else {
+		writer.WriteString(code + "\n")
+	}
+}
+
+// Logs the number of passes and the depth of each.
+func LogPasses(info *gcode.Info, passes int) {
+	logl.Infof("Passes=%d", passes)
+	for pass := 1; pass <= passes; pass++ {
+		logl.Infof("Pass %d depth=%.3f", pass, info.PassDepth(pass))
+	}
+}
+
+// Logs the ranges of the data and the roughing parameters.
+func LogInfo(info *gcode.Info) {
+	logl.Infof("Units=%s MinX=%.3f MaxX=%.3f MinY=%.3f MaxY=%.3f MinZ=%.3f MaxZ=%.3f", info.Units, info.X.Min, info.X.Max, info.Y.Min, info.Y.Max, info.Z.Min, info.Z.Max)
+	for _, axis := range gcode.AuxiliaryAxes {
+		if r := info.Auxiliary(axis); r.IsSet() {
+			logl.Infof("Min%s=%.3f Max%s=%.3f", axis, r.Min, axis, r.Max)
+		}
+	}
+	if info.IsRotary() && info.Top == 0 {
+		logl.Warn("Rotary axis moves in the data, use --radius to step down from the stock radius")
+	}
+	scan := info.ScanDirection()
+	logl.Infof("Scan angle=%.1f", math.Atan2(scan.Y, scan.X)*180/math.Pi)
+	logl.Infof("Increment=%.3f minCut=%.3f skipHeight=%.3f feedRate=%.1f top=%.3f", info.Increment, info.MinCut, info.SkipHeight, info.FeedRate, info.Top)
+	if info.Entry != gcode.Plunge {
+		logl.Infof("Entry=%s angle=%.1f helixRadius=%.3f entryFeed=%.1f", info.Entry, info.EntryAngle, info.HelixRadius, info.EntryFeed)
+	}
 }
 
 func Run(cli *CliType) error {
@@ -234,28 +584,96 @@ func Run(cli *CliType) error {
 			logl.Fatal("Error opening file")
 		}
 	}
-	writer := bufio.NewWriter(fout)
+	var out io.Writer = fout
+	if cli.Renumber || cli.Checksum {
+		logl.Infof("Number lines renumber=%t checksum=%t", cli.Renumber, cli.Checksum)
+		numberer := gcode.NewNumberer(fout, cli.NumberStart, cli.NumberStep)
+		numberer.Renumber = cli.Renumber
+		numberer.Checksum = cli.Checksum
+		defer numberer.Flush() // after the writer is flushed into it
+		out = numberer
+	}
+	writer := bufio.NewWriter(out)
 	defer writer.Flush()
-	blocks := ReadFile(cli.Infile)
+	if cli.Stream {
+		return RunStream(cli, writer)
+	}
+	blocks := ReadFile(cli.Infile, cli.Lenient, cli.Expand)
+	if cli.Linearize.Value > 0 {
+		logl.Infof("Linearize arcs tolerance=%s", cli.Linearize)
+		blocks.Resolve()
+		*blocks = blocks.Linearize(cli.Linearize)
+	}
+	if cli.Absolute {
+		logl.Info("Normalise to absolute distances")
+		blocks.Resolve()
+		*blocks = blocks.ToAbsolute()
+	}
 
-	info := gcode.FindInfo(blocks)
-	info.Increment = cli.Increment
-	info.MinCut = cli.MinCut
-	info.SkipHeight = cli.SkipHeight
-	if cli.Feed <= 0 {
-		logl.Fatal("Feed cannot be zero or negative")
+	if cli.Units != "none" {
+		units := gcode.Millimetres
+		if cli.Units == "in" {
+			units = gcode.Inches
+		}
+		logl.Infof("Converting to %s", units)
+		blocks.Resolve()
+		*blocks = blocks.ConvertUnits(units)
 	}
-	info.FeedRate = cli.Feed
-	info.Pretty = cli.Pretty
 
-	Realign(&info, cli.Align)
+	if cli.Feed.Value <= 0 {
+		logl.Fatal("Feed cannot be zero or negative")
+	}
+	segments := gcode.FindSegments(blocks)
+	logl.Infof("Segments=%d", len(segments))
+	for i := range segments {
+		info := &segments[i]
+		SetParameters(info, cli)
+
+		if info.IsIncremental() { // roughing and alignment work on absolute positions
+			logl.Info("Converting incremental data to absolute")
+			info.Absolute()
+		}
+	}
 
-	logl.Infof("MinX=%.3f MaxX=%.3f MinY=%.3f MaxY=%.3f MinZ=%.3f MaxZ=%.3f", info.X.Min, info.X.Max, info.Y.Min, info.Y.Max, info.Z.Min, info.Z.Max)
-	logl.Infof("Increment=%.3f minCut=%.3f skipHeight=%.3f feedRate=%.0f", info.Increment, info.MinCut, info.SkipHeight, info.FeedRate)
+	Realign(segments, cli.Align)
 
-	OutputBlocks(writer, info.Setup, info.Pretty)
-	Process(writer, info)
-	OutputBlocks(writer, info.Finish, info.Pretty)
+	for i, info := range segments {
+		OutputBlocks(writer, info.Setup, &info)
+		if len(info.Data) == 0 || !IsSelected(cli.Tools, info.Tool) {
+			logl.Infof("Segment %d tool T%d not roughed", i, info.Tool)
+			OutputBlocks(writer, info.Data, &info)
+			OutputBlocks(writer, info.Finish, &info)
+			continue
+		}
+		logl.Infof("Segment %d tool T%d", i, info.Tool)
+		LogInfo(&info)
+		index := 0
+		MapSurface(&info, cli, func() *gcode.Block {
+			if index == len(info.Data) {
+				return nil
+			}
+			index++
+			return info.Data[index-1]
+		})
+		if cli.RoughDiameter.Value > 0 && RoughSurface(writer, &info, cli) {
+			data := info.Data.SplitHelices(&info).SplitAlongSurface(&info) // helical arcs and moves beside the surface are clamped in pieces
+			RestPasses(writer, &info, func() func() *gcode.Block {
+				index := 0
+				return func() *gcode.Block {
+					if index == len(data) {
+						return nil
+					}
+					index++
+					return data[index-1]
+				}
+			})
+			writer.WriteString(";Finish\n")
+			OutputBlocks(writer, info.Data, &info)
+		} else {
+			Process(writer, info)
+		}
+		OutputBlocks(writer, info.Finish, &info)
+	}
 	logl.Info("Finished")
 
 	return nil
@@ -1,2 +1,229 @@
 // core_test.go
 package main
+
+import (
+	"bufio"
+	"fmt"
+	"gincgcode/gcode"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the output of the roughing passes of a raster of three rows of five moves along the direction,
+// at a depth clamped by the first pass, with rows stepped across by the perpendicular.
+func processRaster(t *testing.T, along gcode.Point, across gcode.Point) []string {
+	lines := []string{"G21", "G90", "G0 X0 Y0 Z5", "G1 Z-5 F100"}
+	for row := 0; row < 3; row++ {
+		for i := 0; i <= 5; i++ {
+			step := i
+			if row%2 == 1 { // back along the next row
+				step = 5 - i
+			}
+			if i == 0 && row == 0 {
+				continue
+			}
+			x := along.X*float64(step) + across.X*float64(row)
+			y := along.Y*float64(step) + across.Y*float64(row)
+			lines = append(lines, fmt.Sprintf("X%g Y%g", x, y))
+		}
+	}
+	lines = append(lines, "G0 Z5")
+
+	blocks := gcode.Blocks{}
+	for _, line := range lines {
+		b, err := gcode.ParseLine(line)
+		require.NoError(t, err)
+		blocks = append(blocks, b)
+	}
+	info := gcode.FindInfo(&blocks)
+	info.Increment = -3
+	info.MinCut = 0.5
+	info.SkipHeight = 1
+	info.Tolerance = gcode.DefaultTolerance
+
+	var sb strings.Builder
+	writer := bufio.NewWriter(&sb)
+	Process(writer, info)
+	writer.Flush()
+	return strings.Split(strings.TrimSpace(sb.String()), "\n")
+}
+
+func TestProcessRasters(t *testing.T) {
+	assert := assert.New(t)
+
+	xRaster := processRaster(t, gcode.Point{X: 2}, gcode.Point{Y: 1})
+	tests := map[string]struct {
+		along  gcode.Point
+		across gcode.Point
+	}{
+		"Y raster":        {along: gcode.Point{Y: 2}, across: gcode.Point{X: 1}},
+		"Diagonal raster": {along: gcode.Point{X: 3, Y: 4}, across: gcode.Point{X: -0.8, Y: 0.6}},
+	}
+
+	var roughing int // lines of the first pass
+	for i, line := range xRaster {
+		if strings.HasPrefix(line, ";Pass 2") {
+			roughing = i
+		}
+	}
+	require.NotZero(t, roughing)
+	assert.Equal(9, roughing, "moves along the rows merged in the first pass")
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lines := processRaster(t, tc.along, tc.across)
+			require.Len(t, lines, len(xRaster), "the same moves are skipped as along X")
+			for i, line := range lines {
+				if strings.HasPrefix(line, "G00 Z") || strings.HasPrefix(line, "G01 Z") || strings.HasPrefix(line, ";") {
+					assert.Equal(xRaster[i], line, "line %d", i)
+				}
+			}
+		})
+	}
+}
+
+// Returns the output of roughing a pocket finished by a 1mm end mill with an end mill of the diameter, followed by
+// rest passes where the roughing leaves more than the threshold.
+func processRest(t *testing.T, diameter float64, threshold float64) string {
+	lines := []string{"G21", "G90", "G0 X6 Y6 Z5", "G1 Z-5 F100"}
+	for row := 0; row <= 8; row++ { // points along the rows so that they are clamped away from the walls
+		for step := 1; step <= 8; step++ {
+			x := 6 + step
+			if row%2 == 1 {
+				x = 14 - step
+			}
+			lines = append(lines, fmt.Sprintf("X%d", x))
+		}
+		lines = append(lines, fmt.Sprintf("Y%d", 7+row))
+	}
+	lines = append(lines, "G0 Z5")
+	blocks := gcode.Blocks{}
+	for _, line := range lines {
+		b, err := gcode.ParseLine(line)
+		require.NoError(t, err)
+		blocks = append(blocks, b)
+	}
+	info := gcode.FindInfo(&blocks)
+	cli := CliType{Increment: gcode.Length{Value: -3}, MinCut: gcode.Length{Value: 0.5}, SkipHeight: gcode.Length{Value: 1},
+		Feed: gcode.Length{Value: 100}, Tolerance: gcode.Length{Value: gcode.DefaultTolerance}, DepthRatio: 1,
+		Entry: "plunge", ToolShape: "flat", ToolDiameter: gcode.Length{Value: 1}, RoughDiameter: gcode.Length{Value: diameter}, RestThreshold: gcode.Length{Value: threshold}}
+	SetParameters(&info, &cli)
+	index := 0
+	MapSurface(&info, &cli, func() *gcode.Block {
+		if index == len(info.Data) {
+			return nil
+		}
+		index++
+		return info.Data[index-1]
+	})
+
+	var sb strings.Builder
+	writer := bufio.NewWriter(&sb)
+	if !RoughSurface(writer, &info, &cli) {
+		return ""
+	}
+	RestPasses(writer, &info, func() func() *gcode.Block {
+		index := 0
+		return func() *gcode.Block {
+			if index == len(info.Data) {
+				return nil
+			}
+			index++
+			return info.Data[index-1]
+		}
+	})
+	writer.Flush()
+	return sb.String()
+}
+
+func TestRestPasses(t *testing.T) {
+	assert := assert.New(t)
+
+	out := processRest(t, 4, 0.1)
+	assert.Contains(out, ";Roughing with a 4.000 end mill")
+	assert.Contains(out, ";Rest pass 1 depth -3.000", "the corners are left by the roughing")
+	assert.Contains(out, "M00 ;change to the finish tool")
+
+	out = processRest(t, 4, 10)
+	assert.NotContains(out, ";Rest pass", "nothing thicker than the threshold")
+
+	out = processRest(t, 12, 0.1)
+	assert.Empty(out, "nothing to rough, nor tool changes")
+}
+
+func TestEnter(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		entry     gcode.Entry
+		entryFeed float64
+		surface   bool // a floor at Z-10
+		wall      bool // left at the top beside the start
+		rapid     bool // the block is a modal rapid
+		lines     []string
+		feed      bool    // set on the block
+		g         float64 // set on the block, -1 for none
+	}{
+		"Plunge":                {entry: gcode.Plunge, lines: []string{"G01 Z-2.000"}, g: -1},
+		"Plunge entry feed":     {entry: gcode.Plunge, entryFeed: 200, lines: []string{"G01 Z-2.000 F200"}, feed: true, g: -1},
+		"Plunge before a rapid": {entry: gcode.Plunge, rapid: true, lines: []string{"G01 Z-2.000"}, g: 0},
+		"Ramp":                  {entry: gcode.Ramp, lines: []string{"G1X28.622Y0Z-0.5", "G1X0Y0Z-2"}, g: -1},
+		"Ramp entry feed":       {entry: gcode.Ramp, entryFeed: 200, lines: []string{"G1X28.622Y0Z-0.5F200", "G1X0Y0Z-2"}, feed: true, g: -1},
+		"Helix entry feed":      {entry: gcode.Helix, entryFeed: 200, surface: true, lines: []string{"G3X0Y0Z0.842I0.5J0F200"}, feed: true, g: 1},
+		"Helix without surface": {entry: gcode.Helix, lines: []string{"G01 Z-2.000"}, g: -1},
+		"Helix without room":    {entry: gcode.Helix, surface: true, wall: true, lines: []string{"G01 Z-2.000"}, g: -1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			info := gcode.Info{Entry: tc.entry, EntryAngle: 3, HelixRadius: 0.5, EntryFeed: tc.entryFeed, FeedRate: 500, MinCut: 0.5,
+				Tolerance: gcode.DefaultTolerance, Start: gcode.NewState()}
+			if tc.surface {
+				info.Init()
+				info.X.Update(-5)
+				info.X.Update(45)
+				info.Y.Update(-5)
+				info.Y.Update(5)
+				require.NoError(t, info.NewSurface(gcode.Tool{Shape: gcode.FlatEnd, Diameter: 1}, 0.1))
+				h := info.Surface
+				for i := range h.Z {
+					if !tc.wall || h.X0+float64(i%h.Cols)*h.Cell > -0.5 {
+						h.Z[i] = -10
+					}
+				}
+			}
+			from := gcode.NewState()
+			from.Position = gcode.Point{Z: -2}
+			to := from
+			to.Position = gcode.Point{X: 40, Z: -2}
+			to.Motion = gcode.Linear
+			if tc.rapid {
+				to.Motion = gcode.Rapid
+			}
+			block, err := gcode.ParseLine("X40") // no G word
+			require.NoError(t, err)
+
+			var sb strings.Builder
+			writer := bufio.NewWriter(&sb)
+			enter(writer, &info, &from, &to, 1, block)
+			writer.Flush()
+			lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+			assert.Equal(tc.lines, lines[:len(tc.lines)])
+			if tc.feed {
+				require.NotNil(t, block.F, "the feed of the cuts is restored")
+				assert.EqualValues(500, block.F.Value)
+			} else {
+				assert.Nil(block.F)
+			}
+			if tc.g >= 0 {
+				require.NotNil(t, block.G, "the motion of the block is set")
+				assert.EqualValues(tc.g, block.G.Value)
+			} else {
+				assert.Nil(block.G)
+			}
+		})
+	}
+}
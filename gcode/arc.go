@@ -0,0 +1,319 @@
+// arc
+package gcode
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+type Point struct {
+	X float64
+	Y float64
+	Z float64
+}
+
+// Arc is the geometry of a G02/G03 move in the plane selected by G17/G18/G19,
+// the linear axis is interpolated linearly for helical arcs.
+type Arc struct {
+	Start     Point
+	End       Point
+	Center    Point
+	Radius    float64
+	Clockwise bool
+	Sweep     float64 // radians, negative for clockwise
+	ArcIJK    bool    // absolute I/J
+	Plane     Plane
+}
+
+// True if the block is a G02/G03, or moves while the resolved motion mode is an arc.
+func (b *Block) IsArc() bool {
+	if b.G != nil {
+		return b.G.Value == 2 || b.G.Value == 3
+	}
+	return b.State.IsArc() && b.IsMove()
+}
+
+func (b *Block) isClockwise() bool {
+	if b.G != nil {
+		return b.G.Value == 2
+	}
+	return b.State.Motion == ArcCW
+}
+
+// Returns the end point of the block, words that are not present are taken from start.
+// Words are added to start if the resolved distance mode is incremental.
+func (b *Block) EndPoint(start Point) Point {
+	end := start
+	if b.X != nil {
+		end.X = b.State.axis(start.X, b.X.Value)
+	}
+	if b.Y != nil {
+		end.Y = b.State.axis(start.Y, b.Y.Value)
+	}
+	if b.Z != nil {
+		end.Z = b.State.axis(start.Z, b.Z.Value)
+	}
+	return end
+}
+
+// Returns the coordinates of p in the plane and along the linear axis of the plane.
+func (pl Plane) project(p Point) (u float64, v float64, w float64) {
+	switch pl {
+	case PlaneZX:
+		return p.Z, p.X, p.Y
+	case PlaneYZ:
+		return p.Y, p.Z, p.X
+	}
+	return p.X, p.Y, p.Z
+}
+
+// Returns the point from coordinates in the plane and along the linear axis.
+func (pl Plane) point(u float64, v float64, w float64) Point {
+	switch pl {
+	case PlaneZX:
+		return Point{X: v, Y: w, Z: u}
+	case PlaneYZ:
+		return Point{X: w, Y: u, Z: v}
+	}
+	return Point{X: u, Y: v, Z: w}
+}
+
+// Returns the arc center offset words of the plane, I/J for G17, K/I for G18 and J/K for G19.
+func (pl Plane) offsets(b *Block) (*CodeCmd, *CodeCmd) {
+	switch pl {
+	case PlaneZX:
+		return b.K, b.I
+	case PlaneYZ:
+		return b.J, b.K
+	}
+	return b.I, b.J
+}
+
+// Calculates the arc geometry of the block moving from start in the resolved plane.
+func (b *Block) Arc(start Point) (Arc, error) {
+	if !b.IsArc() {
+		return Arc{}, errors.New("Block is not an arc")
+	}
+	plane := b.State.Plane
+	arc := Arc{Start: start, End: b.EndPoint(start), Clockwise: b.isClockwise(), ArcIJK: b.State.ArcIJK, Plane: plane}
+	u0, v0, w0 := plane.project(start)
+	u1, v1, _ := plane.project(arc.End)
+	var uc, vc float64
+	offsetU, offsetV := plane.offsets(b)
+
+	if b.R != nil {
+		if offsetU != nil || offsetV != nil {
+			return arc, errors.New("Arc has both R and centre offsets")
+		}
+		du := u1 - u0
+		dv := v1 - v0
+		d := math.Hypot(du, dv)
+		if d == 0 {
+			return arc, errors.New("R arc with same start and end")
+		}
+		r := b.R.Value
+		h2 := r*r - d*d/4
+		if h2 < 0 {
+			if h2 < -1e-3 {
+				return arc, errors.New("R arc radius too small for end point")
+			}
+			h2 = 0
+		}
+		h := math.Sqrt(h2)
+		if (r < 0) != !arc.Clockwise { // negative R is the long way round
+			h = -h
+		}
+		uc = u0 + du/2 + h*dv/d
+		vc = v0 + dv/2 - h*du/d
+		arc.Radius = math.Abs(r)
+	} else {
+		if offsetU == nil && offsetV == nil {
+			return arc, errors.New("Arc has no centre offsets or R")
+		}
+		uc = u0
+		vc = v0
+		if b.State.ArcIJK { // G90.1
+			if offsetU != nil {
+				uc = offsetU.Value
+			}
+			if offsetV != nil {
+				vc = offsetV.Value
+			}
+		} else {
+			if offsetU != nil {
+				uc += offsetU.Value
+			}
+			if offsetV != nil {
+				vc += offsetV.Value
+			}
+		}
+		arc.Radius = math.Hypot(u0-uc, v0-vc)
+	}
+	arc.Center = plane.point(uc, vc, w0)
+
+	a0 := arc.angle(start)
+	a1 := arc.angle(arc.End)
+	arc.Sweep = a1 - a0
+	if arc.Clockwise {
+		if arc.Sweep >= 0 {
+			arc.Sweep -= 2 * math.Pi
+		}
+	} else {
+		if arc.Sweep <= 0 {
+			arc.Sweep += 2 * math.Pi
+		}
+	}
+	return arc, nil
+}
+
+func (a *Arc) angle(p Point) float64 {
+	u, v, _ := a.Plane.project(p)
+	uc, vc, _ := a.Plane.project(a.Center)
+	return math.Atan2(v-vc, u-uc)
+}
+
+// True if the arc moves along the linear axis of its plane.
+func (a *Arc) IsHelical() bool {
+	_, _, w0 := a.Plane.project(a.Start)
+	_, _, w1 := a.Plane.project(a.End)
+	return w0 != w1
+}
+
+// Length of the arc in its plane.
+func (a *Arc) Length() float64 {
+	return math.Abs(a.Sweep) * a.Radius
+}
+
+// Returns the point at fraction t (0..1) along the arc.
+func (a *Arc) PointAt(t float64) Point {
+	if t <= 0 {
+		return a.Start
+	}
+	if t >= 1 {
+		return a.End
+	}
+	angle := a.angle(a.Start) + a.Sweep*t
+	uc, vc, _ := a.Plane.project(a.Center)
+	_, _, w0 := a.Plane.project(a.Start)
+	_, _, w1 := a.Plane.project(a.End)
+	return a.Plane.point(
+		uc+a.Radius*math.Cos(angle),
+		vc+a.Radius*math.Sin(angle),
+		w0+(w1-w0)*t,
+	)
+}
+
+// Creates an absolute I/J arc block from start to end around the arc center, F is only set if feed is not nil.
+func (a *Arc) block(start Point, end Point, feed *CodeCmd) *Block {
+	block := new(Block)
+	block.Init()
+	if a.Clockwise {
+		block.SetG(2)
+	} else {
+		block.SetG(3)
+	}
+	block.SetX(end.X)
+	block.SetY(end.Y)
+	block.SetZ(end.Z)
+	if a.ArcIJK {
+		block.SetI(a.Center.X)
+		block.SetJ(a.Center.Y)
+	} else {
+		block.SetI(a.Center.X - start.X)
+		block.SetJ(a.Center.Y - start.Y)
+	}
+	if feed != nil {
+		block.SetF(feed.Value)
+	}
+	return block
+}
+
+// Splits the arc at each Z where it crosses the depth of a pass below info.Top,
+// so that every piece can be clamped by ToStepZ to its own pass.
+func (a *Arc) SplitHelix(info *Info, feed *CodeCmd) Blocks {
+	pieces := make(Blocks, 0)
+	if a.Plane != PlaneXY || !a.IsHelical() || info.Increment >= 0 {
+		return pieces
+	}
+	z0 := a.Start.Z - info.Top
+	z1 := a.End.Z - info.Top
+	lo := math.Min(z0, z1)
+	hi := math.Max(z0, z1)
+
+	ts := make([]float64, 0)
+	for k := 1; info.Depth(k) > lo; k++ { // levels are at the depths of the passes
+		level := info.Depth(k)
+		if level < hi {
+			ts = append(ts, (level-z0)/(z1-z0))
+		}
+	}
+	if len(ts) == 0 {
+		return pieces
+	}
+	sort.Float64s(ts)
+	ts = append(ts, 1)
+
+	from := a.Start
+	for i, t := range ts {
+		to := a.PointAt(t)
+		var f *CodeCmd
+		if i == 0 { // only the first piece needs the feed
+			f = feed
+		}
+		pieces = append(pieces, a.block(from, to, f))
+		from = to
+	}
+	return pieces
+}
+
+// Returns the points where the arc reaches its extremes in X or Y.
+func (a *Arc) Extents() []Point {
+	points := make([]Point, 0, 4)
+	a0 := a.angle(a.Start)
+	for q := -8; q <= 8; q++ { // quadrant angles
+		angle := float64(q) * math.Pi / 2
+		t := (angle - a0) / a.Sweep
+		if t > 0 && t < 1 {
+			points = append(points, a.PointAt(t))
+		}
+	}
+	return points
+}
+
+// Returns the blocks with every helical arc that crosses a pass level split into pieces.
+// Arcs in the ZX and YZ planes are linearized as Z changes along them.
+// The blocks must be resolved, blocks that are not split are not copied.
+func (bs Blocks) SplitHelices(info *Info) Blocks {
+	result := make(Blocks, 0, len(bs))
+	for _, block := range bs {
+		if !block.IsArc() || block.State.InverseTime { // G93 feeds belong to the whole arc
+			result = append(result, block)
+			continue
+		}
+		arc, err := block.Arc(block.Start)
+		if err != nil {
+			result = append(result, block)
+			continue
+		}
+		if arc.Plane != PlaneXY {
+			result = append(result, block.linearize(&arc, info.MinCut/10)...)
+			continue
+		}
+		pieces := arc.SplitHelix(info, block.F)
+		if len(pieces) == 0 {
+			result = append(result, block)
+			continue
+		}
+		start := block.Start
+		for _, piece := range pieces { // the pieces share the modal state of the arc
+			piece.Start = start
+			piece.State = block.State
+			piece.BlockDelete = block.BlockDelete
+			piece.State.Position = piece.EndPoint(start)
+			start = piece.State.Position
+		}
+		result = append(result, pieces...)
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArc(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		line    string
+		start   Point
+		centerX float64
+		centerY float64
+		radius  float64
+		sweep   float64
+	}{
+		"G2 IJ quarter":  {line: "G2 X1 Y0 I0 J-1", start: Point{X: 0, Y: 1}, centerX: 0, centerY: 0, radius: 1, sweep: -math.Pi / 2},
+		"G3 IJ quarter":  {line: "G3 X0 Y1 I-1 J0", start: Point{X: 1, Y: 0}, centerX: 0, centerY: 0, radius: 1, sweep: math.Pi / 2},
+		"G2 IJ circle":   {line: "G2 X1 Y0 I-1", start: Point{X: 1, Y: 0}, centerX: 0, centerY: 0, radius: 1, sweep: -2 * math.Pi},
+		"G2 R short":     {line: "G2 X2 Y0 R1.4142136", start: Point{}, centerX: 1, centerY: -1, radius: math.Sqrt2, sweep: -math.Pi / 2},
+		"G2 R long":      {line: "G2 X2 Y0 R-1.4142136", start: Point{}, centerX: 1, centerY: 1, radius: math.Sqrt2, sweep: -3 * math.Pi / 2},
+		"G3 R short":     {line: "G3 X2 Y0 R1.4142136", start: Point{}, centerX: 1, centerY: 1, radius: math.Sqrt2, sweep: math.Pi / 2},
+		"G3 R half":      {line: "G03 X2 Y0 R1", start: Point{}, centerX: 1, centerY: 0, radius: 1, sweep: math.Pi},
+		"G2 helix IJ Z":  {line: "G2 X1 Y0 Z-1 I0 J-1", start: Point{X: 0, Y: 1}, centerX: 0, centerY: 0, radius: 1, sweep: -math.Pi / 2},
+		"G3 IJ off zero": {line: "G3 X10 Y12 I0 J1", start: Point{X: 10, Y: 10}, centerX: 10, centerY: 11, radius: 1, sweep: math.Pi},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := ParseLine(tc.line)
+			require.Emptyf(t, err, "failed to parse '%s': %s", tc.line, err)
+			require.True(t, b.IsArc(), "not an arc")
+			arc, err := b.Arc(tc.start)
+			require.Emptyf(t, err, "failed arc '%s': %s", tc.line, err)
+			assert.InDelta(tc.centerX, arc.Center.X, 1e-4, "Center X")
+			assert.InDelta(tc.centerY, arc.Center.Y, 1e-4, "Center Y")
+			assert.InDelta(tc.radius, arc.Radius, 1e-4, "Radius")
+			assert.InDelta(tc.sweep, arc.Sweep, 1e-4, "Sweep")
+			end := arc.PointAt(1)
+			assert.EqualValues(b.EndPoint(tc.start), end, "End")
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		b, err := ParseLine("G2 X1 Y1")
+		require.Empty(t, err)
+		_, err = b.Arc(Point{})
+		assert.NotEmpty(err, "no centre")
+
+		_, err = ParseLine("G2 X1 Y1 I1 R1")
+		assert.NotEmpty(err, "R and I")
+
+		b, err = ParseLine("G2 X10 Y0 R1")
+		require.Empty(t, err)
+		_, err = b.Arc(Point{})
+		assert.NotEmpty(err, "R too small")
+	})
+
+	t.Run("Planes", func(t *testing.T) {
+		b18, _ := ParseLine("G18 G3 X1 Z0 I0 K-1")
+		b19, _ := ParseLine("G19 G3 Y0 Z1 J-1 K0")
+		blocks := Blocks{b18, b19}
+		blocks.Resolve()
+
+		arc, err := b18.Arc(Point{X: 0, Z: 1})
+		require.Empty(t, err)
+		assert.EqualValues(PlaneZX, arc.Plane)
+		assert.InDelta(1, arc.Radius, 1e-5)
+		assert.InDelta(math.Pi/2, arc.Sweep, 1e-5)
+		p := arc.PointAt(0.5)
+		assert.InDelta(math.Sqrt2/2, p.X, 1e-5)
+		assert.InDelta(math.Sqrt2/2, p.Z, 1e-5)
+
+		arc, err = b19.Arc(Point{Y: 1, Z: 0})
+		require.Empty(t, err)
+		assert.InDelta(0, arc.Center.Y, 1e-5)
+		assert.InDelta(0, arc.Center.Z, 1e-5)
+		assert.InDelta(math.Pi/2, arc.Sweep, 1e-5)
+	})
+
+	t.Run("PointAt", func(t *testing.T) {
+		b, _ := ParseLine("G3 X-1 Y0 Z-2 I-1 J0")
+		arc, err := b.Arc(Point{X: 1, Y: 0, Z: 0})
+		require.Empty(t, err)
+		p := arc.PointAt(0.5)
+		assert.InDelta(0, p.X, 1e-5)
+		assert.InDelta(1, p.Y, 1e-5)
+		assert.InDelta(-1, p.Z, 1e-5)
+		assert.InDelta(math.Pi, arc.Length(), 1e-5)
+	})
+}
+
+func TestSplitHelices(t *testing.T) {
+	assert := assert.New(t)
+	info := Info{Increment: -3.0, MinCut: 0.5}
+
+	t.Run("Crossing", func(t *testing.T) {
+		b1, _ := ParseLine("G0 X1 Y0 Z-1")
+		b2, _ := ParseLine("G2 X-1 Y0 Z-7 I-1 J0 F100") // half circle from -1 to -7 crosses -3 and -6
+		b3, _ := ParseLine("G1 X0")
+		blocks := Blocks{b1, b2, b3}
+		blocks.Resolve()
+		got := blocks.SplitHelices(&info)
+		require.EqualValues(t, 5, len(got))
+		assert.Same(b1, got[0])
+		assert.Same(b3, got[4])
+
+		assert.InDelta(-3, got[1].Z.Value, 1e-5)
+		assert.InDelta(-6, got[2].Z.Value, 1e-5)
+		assert.InDelta(-7, got[3].Z.Value, 1e-5)
+		assert.NotEmpty(got[1].F, "feed on first piece")
+		assert.Empty(got[2].F, "feed only on first piece")
+
+		pos := Point{X: 1, Y: 0, Z: -1}
+		for _, piece := range got[1:4] {
+			assert.EqualValues(2, piece.G.Value)
+			arc, err := piece.Arc(pos)
+			require.Empty(t, err)
+			assert.InDelta(0, arc.Center.X, 1e-5, "Center X")
+			assert.InDelta(0, arc.Center.Y, 1e-5, "Center Y")
+			assert.InDelta(1, arc.Radius, 1e-5, "Radius")
+			pos = piece.EndPoint(pos)
+		}
+		assert.InDelta(-1, pos.X, 1e-5)
+		assert.InDelta(0, pos.Y, 1e-5)
+	})
+
+	t.Run("Other plane", func(t *testing.T) {
+		b1, _ := ParseLine("G0 X0 Y0 Z0")
+		b2, _ := ParseLine("G18 G2 X2 Z0 I1 K0")
+		blocks := Blocks{b1, b2}
+		blocks.Resolve()
+		got := blocks.SplitHelices(&info)
+		require.Greater(t, len(got), 2, "linearized")
+		for _, b := range got[1:] {
+			assert.EqualValues(1, b.G.Value)
+			assert.NotEmpty(b.Z)
+		}
+		assert.InDelta(2, got[len(got)-1].X.Value, 1e-5)
+	})
+
+	t.Run("Not crossing", func(t *testing.T) {
+		b1, _ := ParseLine("G0 X1 Y0 Z-3.5")
+		b2, _ := ParseLine("G2 X-1 Y0 Z-5 R1")
+		b3, _ := ParseLine("G2 X1 Y0 R1")
+		blocks := Blocks{b1, b2, b3}
+		blocks.Resolve()
+		got := blocks.SplitHelices(&info)
+		require.EqualValues(t, 3, len(got))
+		assert.Same(b2, got[1])
+		assert.Same(b3, got[2])
+	})
+}
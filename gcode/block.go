@@ -11,16 +11,33 @@ import (
 type Blocks []*Block
 
 type Block struct {
-	Cmds      []CodeCmd
-	HasData   bool
-	IsClamped bool
-	IsSkip    bool
-	X         *CodeCmd
-	Y         *CodeCmd
-	Z         *CodeCmd
-	G         *CodeCmd
-	F         *CodeCmd
-	LastPass  int
+	Cmds        []CodeCmd
+	HasData     bool
+	IsClamped   bool
+	IsSkip      bool
+	BlockDelete bool // the line starts with the '/' of block delete, the block is skipped if it is on
+	X           *CodeCmd
+	Y           *CodeCmd
+	Z           *CodeCmd
+	G           *CodeCmd
+	F           *CodeCmd
+	I           *CodeCmd
+	J           *CodeCmd
+	K           *CodeCmd
+	R           *CodeCmd
+	A           *CodeCmd // rotary axes
+	B           *CodeCmd
+	C           *CodeCmd
+	U           *CodeCmd // auxiliary linear axes
+	V           *CodeCmd
+	W           *CodeCmd
+	AxisCmd     *CodeCmd // non motion command using the axis words, e.g. G92, G28 or an unsupported G/M code
+	LastPass    int
+	Start       Point  // resolved position before the block
+	State       State  // resolved modal state after the block
+	Source      string // line the block was parsed from
+	Line        int    // line number of the source in the file, 0 if not read from a file
+	sourceCmds  int    // number of words parsed from Source
 }
 
 func (b *Block) Init() {
@@ -28,11 +45,28 @@ func (b *Block) Init() {
 	b.HasData = false
 	b.IsClamped = false
 	b.IsSkip = false
+	b.BlockDelete = false
 	b.X = nil
 	b.Y = nil
 	b.Z = nil
 	b.G = nil
+	b.I = nil
+	b.J = nil
+	b.K = nil
+	b.R = nil
+	b.A = nil
+	b.B = nil
+	b.C = nil
+	b.U = nil
+	b.V = nil
+	b.W = nil
+	b.AxisCmd = nil
 	b.LastPass = 0
+	b.Start = Point{}
+	b.State = State{}
+	b.Source = ""
+	b.Line = 0
+	b.sourceCmds = 0
 }
 
 func (b *Block) Copy() Block {
@@ -46,7 +80,13 @@ func (b *Block) Copy() Block {
 
 	block.IsClamped = b.IsClamped
 	block.IsSkip = b.IsSkip
+	block.BlockDelete = b.BlockDelete
 	block.LastPass = b.LastPass
+	block.Start = b.Start
+	block.State = b.State
+	block.Source = b.Source
+	block.Line = b.Line
+	block.sourceCmds = b.sourceCmds
 	return block
 }
 
@@ -54,22 +94,36 @@ func (b *Block) Parse(multiCheck bool) error {
 	b.HasData = false
 
 	for i, cmd := range b.Cmds {
+		if cmd.Cmd == "G" && (cmd.Value == 92 || cmd.Value == 28 || cmd.Value == 30) {
+			if multiCheck && b.AxisCmd != nil && b.AxisCmd.Type != Opaque {
+				return newParseError(&cmd, "Multiple commands using axis words in block")
+			}
+			b.AxisCmd = &b.Cmds[i]
+		} else if b.AxisCmd == nil && cmd.IsOpaqueCode() { // its axis words are not known to be a move
+			b.AxisCmd = &b.Cmds[i]
+		}
+	}
+
+	for i, cmd := range b.Cmds {
+		if b.AxisCmd != nil && isAxis(cmd.Cmd) {
+			continue // not a move
+		}
 
 		switch cmd.Cmd {
 		case "F":
 			{
 				b.HasData = true
 				if multiCheck && b.F != nil {
-					return errors.New("Multiple F values in block")
+					return newParseError(&cmd, "Multiple F values in block")
 				}
 				b.F = &b.Cmds[i]
 			}
 		case "G":
 			{
-				if cmd.Value <= 1 { //only select G0 and G1
+				if cmd.Value <= 3 { //only select motion G0 to G3
 					b.HasData = true
 					if multiCheck && b.G != nil {
-						return errors.New("Multiple G0/G1 in block")
+						return newParseError(&cmd, "Multiple G0/G1/G2/G3 in block")
 					}
 					b.G = &b.Cmds[i]
 				}
@@ -78,7 +132,7 @@ func (b *Block) Parse(multiCheck bool) error {
 			{
 				b.HasData = true
 				if multiCheck && b.X != nil {
-					return errors.New("Multiple X values in block")
+					return newParseError(&cmd, "Multiple X values in block")
 				}
 				b.X = &b.Cmds[i]
 			}
@@ -86,7 +140,7 @@ func (b *Block) Parse(multiCheck bool) error {
 			{
 				b.HasData = true
 				if multiCheck && b.Y != nil {
-					return errors.New("Multiple Y values in block")
+					return newParseError(&cmd, "Multiple Y values in block")
 				}
 				b.Y = &b.Cmds[i]
 			}
@@ -94,30 +148,239 @@ func (b *Block) Parse(multiCheck bool) error {
 			{
 				b.HasData = true
 				if multiCheck && b.Z != nil {
-					return errors.New("Multiple Z values in block")
+					return newParseError(&cmd, "Multiple Z values in block")
 				}
 				b.Z = &b.Cmds[i]
 			}
+		case "I":
+			{
+				b.HasData = true
+				if multiCheck && b.I != nil {
+					return newParseError(&cmd, "Multiple I values in block")
+				}
+				b.I = &b.Cmds[i]
+			}
+		case "J":
+			{
+				b.HasData = true
+				if multiCheck && b.J != nil {
+					return newParseError(&cmd, "Multiple J values in block")
+				}
+				b.J = &b.Cmds[i]
+			}
+		case "K":
+			{
+				b.HasData = true
+				if multiCheck && b.K != nil {
+					return newParseError(&cmd, "Multiple K values in block")
+				}
+				b.K = &b.Cmds[i]
+			}
+		case "R":
+			{
+				b.HasData = true
+				if multiCheck && b.R != nil {
+					return newParseError(&cmd, "Multiple R values in block")
+				}
+				b.R = &b.Cmds[i]
+			}
+		case "A", "B", "C", "U", "V", "W":
+			{
+				b.HasData = true
+				word := b.auxiliary(cmd.Cmd)
+				if multiCheck && *word != nil {
+					return newParseError(&cmd, fmt.Sprintf("Multiple %s values in block", cmd.Cmd))
+				}
+				*word = &b.Cmds[i]
+			}
 		}
 	}
+	if multiCheck && b.IsArc() && b.R != nil && (b.I != nil || b.J != nil) {
+		return newParseError(b.R, "Arc with both R and I/J")
+	}
 	return nil
 }
 
-func (b *Block) Reposition(offsetX float32, offsetY float32) {
-	if b.X != nil && offsetX != 0 {
-		b.SetX(b.X.Value + offsetX)
+// True if the word is the name of an axis.
+func isAxis(cmd string) bool {
+	switch cmd {
+	case "X", "Y", "Z", "A", "B", "C", "U", "V", "W":
+		return true
+	}
+	return false
+}
+
+// Returns the field of the rotary or auxiliary linear axis word.
+func (b *Block) auxiliary(cmd string) **CodeCmd {
+	switch cmd {
+	case "A":
+		return &b.A
+	case "B":
+		return &b.B
+	case "C":
+		return &b.C
+	case "U":
+		return &b.U
+	case "V":
+		return &b.V
+	}
+	return &b.W
+}
+
+// Moves the block by the offsets, the resolved positions are moved as well.
+// Incremental words are unchanged, absolute arc centers are moved. The axis words of a G28/G30 are the
+// intermediate point it moves through in the work coordinates, so they are moved on purpose to keep the
+// point where it is over the data. The home position is in the machine and is not moved.
+func (b *Block) Reposition(offsetX float64, offsetY float64) {
+	if b.State.Distance == Absolute {
+		if b.X != nil && offsetX != 0 {
+			b.SetX(b.X.Value + offsetX)
+		}
+		if b.Y != nil && offsetY != 0 {
+			b.SetY(b.Y.Value + offsetY)
+		}
+	}
+	if b.State.ArcIJK && b.IsArc() {
+		if b.I != nil && offsetX != 0 {
+			b.SetI(b.I.Value + offsetX)
+		}
+		if b.J != nil && offsetY != 0 {
+			b.SetJ(b.J.Value + offsetY)
+		}
+	}
+	if b.IsHome() && b.State.Distance == Absolute { // the intermediate point moves with the data
+		for i, cmd := range b.Cmds {
+			switch cmd.Cmd {
+			case "X":
+				b.Cmds[i].SetValue(b.Cmds[i].Value + offsetX)
+			case "Y":
+				b.Cmds[i].SetValue(b.Cmds[i].Value + offsetY)
+			}
+		}
+	}
+	b.Start.X += offsetX
+	b.Start.Y += offsetY
+	b.State.Position.X += offsetX
+	b.State.Position.Y += offsetY
+}
+
+// Replaces incremental axis words with the resolved absolute positions and G91 with G90.
+// The block must be resolved.
+func (b *Block) ToAbsolute() {
+	for i, cmd := range b.Cmds {
+		if cmd.Cmd == "G" && cmd.Value == 91 {
+			b.Cmds[i].SetValue(90)
+		}
+	}
+	if b.IsHome() && b.State.Distance == Incremental { // the intermediate point is relative to the start
+		for i, cmd := range b.Cmds {
+			switch cmd.Cmd {
+			case "X":
+				b.Cmds[i].SetValue(b.Cmds[i].Value + b.Start.X)
+			case "Y":
+				b.Cmds[i].SetValue(b.Cmds[i].Value + b.Start.Y)
+			case "Z":
+				b.Cmds[i].SetValue(b.Cmds[i].Value + b.Start.Z)
+			}
+		}
+	}
+	if b.State.Distance == Incremental {
+		if b.X != nil {
+			b.X.SetValue(b.State.Position.X)
+		}
+		if b.Y != nil {
+			b.Y.SetValue(b.State.Position.Y)
+		}
+		if b.Z != nil {
+			b.Z.SetValue(b.State.Position.Z)
+		}
+		for _, axis := range AuxiliaryAxes {
+			if word := *b.auxiliary(axis); word != nil {
+				word.SetValue(b.State.Aux.Get(axis))
+			}
+		}
+	}
+	b.State.Distance = Absolute
+}
+
+// Returns absolute copies of the resolved blocks.
+func (bs Blocks) ToAbsolute() Blocks {
+	result := make(Blocks, len(bs))
+	for i, block := range bs {
+		c := block.Copy()
+		c.ToAbsolute()
+		result[i] = &c
+	}
+	return result
+}
+
+// True if the block is a G28/G30 return to a home position.
+func (b *Block) IsHome() bool {
+	return b.AxisCmd != nil && b.AxisCmd.Type != Opaque && (b.AxisCmd.Value == 28 || b.AxisCmd.Value == 30)
+}
+
+// Returns the N word line number of the block, -1 if it has none.
+func (b *Block) Number() int {
+	if n := b.word("N"); n != nil {
+		return int(n.Value)
+	}
+	return -1
+}
+
+// True if the block has M06.
+func (b *Block) IsToolChange() bool {
+	for _, cmd := range b.Cmds {
+		if cmd.Cmd == "M" && cmd.Value == 6 {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the block has an axis word.
+func (b *Block) IsMove() bool {
+	return b.X != nil || b.Y != nil || b.Z != nil || b.IsAuxiliaryMove()
+}
+
+// True if the block has a rotary or auxiliary linear axis word.
+func (b *Block) IsAuxiliaryMove() bool {
+	return b.A != nil || b.B != nil || b.C != nil || b.U != nil || b.V != nil || b.W != nil
+}
+
+// True if the words of the block are all still those parsed from the source line.
+func (b *Block) Unchanged() bool {
+	if b.Source == "" || len(b.Cmds) != b.sourceCmds {
+		return false
 	}
-	if b.Y != nil && offsetY != 0 {
-		b.SetY(b.Y.Value + offsetY)
+	for _, cmd := range b.Cmds {
+		if cmd.Source == "" {
+			return false
+		}
 	}
+	return true
 }
 
+// Unchanged blocks are returned as the source line unless pretty.
 func (b *Block) String(newline bool, pretty bool) string {
 	var sb strings.Builder
-	for _, cmd := range b.Cmds {
-		sb.WriteString(cmd.String(pretty))
-		if pretty {
-			sb.WriteString(" ")
+	decimals := 3
+	if b.State.Units == Inches {
+		decimals = 4
+	}
+	if !pretty && b.Unchanged() {
+		sb.WriteString(b.Source)
+	} else {
+		if b.BlockDelete {
+			sb.WriteString("/")
+		}
+		for _, cmd := range b.Cmds {
+			if cmd.Cmd == "*" { // the checksum of the source no longer matches
+				continue
+			}
+			sb.WriteString(cmd.Format(pretty, decimals))
+			if pretty {
+				sb.WriteString(" ")
+			}
 		}
 	}
 	if newline {
@@ -126,42 +389,74 @@ func (b *Block) String(newline bool, pretty bool) string {
 	return sb.String()
 }
 
-func (b *Block) SetX(value float32) {
+// Adds the word before a ';' comment, which runs to the end of the line.
+func (b *Block) add(cmd CodeCmd) {
+	n := len(b.Cmds)
+	if n > 0 && b.Cmds[n-1].Type == Comment && strings.HasPrefix(b.Cmds[n-1].Cmd, ";") {
+		b.Cmds = append(b.Cmds[:n-1:n-1], cmd, b.Cmds[n-1])
+		return
+	}
+	b.Cmds = append(b.Cmds, cmd)
+}
+
+func (b *Block) SetX(value float64) {
 	if b.X != nil {
-		b.X.Value = value
+		b.X.SetValue(value)
 	} else {
 		cmd := CodeCmd{Cmd: "X", Value: value, Type: ValueFloat}
-		b.Cmds = append(b.Cmds, cmd)
+		b.add(cmd)
 		b.Parse(false)
 		b.HasData = true
 	}
 }
 
-func (b *Block) SetY(value float32) {
+func (b *Block) SetY(value float64) {
 	if b.Y != nil {
-		b.Y.Value = value
+		b.Y.SetValue(value)
 	} else {
 		cmd := CodeCmd{Cmd: "Y", Value: value, Type: ValueFloat}
-		b.Cmds = append(b.Cmds, cmd)
+		b.add(cmd)
 		b.Parse(false)
 		b.HasData = true
 	}
 }
 
-func (b *Block) SetZ(value float32) {
+func (b *Block) SetZ(value float64) {
 	if b.Z != nil {
-		b.Z.Value = value
+		b.Z.SetValue(value)
 	} else {
 		cmd := CodeCmd{Cmd: "Z", Value: value, Type: ValueFloat}
-		b.Cmds = append(b.Cmds, cmd)
+		b.add(cmd)
 		b.Parse(false)
 		b.HasData = true
 	}
 }
 
-func (b *Block) SetG(value float32) {
+func (b *Block) SetI(value float64) {
+	if b.I != nil {
+		b.I.SetValue(value)
+	} else {
+		cmd := CodeCmd{Cmd: "I", Value: value, Type: ValueFloat}
+		b.add(cmd)
+		b.Parse(false)
+		b.HasData = true
+	}
+}
+
+func (b *Block) SetJ(value float64) {
+	if b.J != nil {
+		b.J.SetValue(value)
+	} else {
+		cmd := CodeCmd{Cmd: "J", Value: value, Type: ValueFloat}
+		b.add(cmd)
+		b.Parse(false)
+		b.HasData = true
+	}
+}
+
+func (b *Block) SetG(value float64) {
 	if b.G != nil {
-		b.G.Value = value
+		b.G.SetValue(value)
 	} else {
 		cmd := CodeCmd{Cmd: "G", Value: value, Type: Address}
 		b.Cmds = append([]CodeCmd{cmd}, b.Cmds...)
@@ -170,53 +465,85 @@ func (b *Block) SetG(value float32) {
 	}
 }
 
-func (b *Block) SetF(value float32) {
+func (b *Block) SetF(value float64) {
+	cmdType := ValueInt
+	if value != math.Trunc(value) { // inch feeds have decimals
+		cmdType = ValueFloat
+	}
 	if b.F != nil {
-		b.F.Value = value
+		b.F.SetValue(value)
+		b.F.Type = cmdType
 	} else {
-		cmd := CodeCmd{Cmd: "F", Value: value, Type: ValueInt}
-		b.Cmds = append(b.Cmds, cmd)
+		cmd := CodeCmd{Cmd: "F", Value: value, Type: cmdType}
+		b.add(cmd)
 		b.Parse(false)
 		b.HasData = true
 	}
 }
 
-func (b *Block) NoChangeY(value float32) bool {
+func (b *Block) NoChangeY(value float64, tolerance float64) bool {
 	if b.Y == nil {
 		return true
 	}
-	return b.Y.Value == value
+	return Near(b.Y.Value, value, tolerance)
 }
 
-func (b *Block) NoChangeZ(value float32) bool {
+func (b *Block) NoChangeZ(value float64, tolerance float64) bool {
 	if b.Z == nil {
 		return true
 	}
-	return b.Z.Value == value
+	return Near(b.Z.Value, value, tolerance)
 }
 
+// Clamps Z to the depth of the pass leaving MinCut, the block must be absolute.
+// Z is clamped in the frame of the start of the data so G92 offsets in the data are allowed for.
+// With a surface the tip is also raised so that the tool leaves MinCut normal to the surface,
+// and moves without Z are given one.
 func (b *Block) ToStepZ(info *Info, pass int) {
-	if b.IsClamped || b.Z == nil {
+	if b.IsClamped {
+		return
+	}
+	surface := info.Surface != nil && b.IsMove() && (!b.IsArc() || b.State.Plane == PlaneXY) && b.State.KnownX && b.State.KnownY && b.State.KnownZ
+	if b.Z == nil && !surface {
 		return
 	}
-	if (*b.Z).Value >= 0 {
+	offset := info.Shift(&b.State)
+	shift := offset.Z - info.Top // steps are below the top of the stock
+	z := b.State.Position.Z + shift
+	if b.Z != nil {
+		z = (*b.Z).Value + shift
+	}
+	if z >= 0 {
 		b.LastPass = 0
 		b.IsClamped = false
 		return
 	}
 	//working with negative Z
-	zMaxCut := info.Increment * float32(pass)
-	b.LastPass = int(math.Ceil(float64((*b.Z).Value/info.Increment)) - 1)
+	zMaxCut := info.Depth(pass)
+	b.LastPass = info.PassOf(z) - 1
 
-	zCut := info.Increment * float32(b.LastPass)
+	zCut := info.Depth(b.LastPass)
 	if zCut < zMaxCut {
 		zCut = zMaxCut
 	}
-	b.SetZ(zCut + info.MinCut)
+	zCut += info.MinCut
+	if surface {
+		zCut = math.Max(zCut, info.Clearance(b.State.Position.X+offset.X, b.State.Position.Y+offset.Y)-info.Top)
+	}
+	b.SetZ(zCut - shift)
 	b.IsClamped = true
 }
 
 func ParseLine(line string) (*Block, error) {
+	return parseLine(line, false)
+}
+
+// Parses the line keeping unknown letters and unsupported codes as Opaque words.
+func ParseLineLenient(line string) (*Block, error) {
+	return parseLine(line, true)
+}
+
+func parseLine(line string, lenient bool) (*Block, error) {
 	block := new(Block)
 	block.Init()
 
@@ -228,6 +555,7 @@ func ParseLine(line string) (*Block, error) {
 	rs := NewRunesScanner(line)
 	for rs.Scan() {
 		var cc CodeCmd
+		column := rs.index + 1
 		r := unicode.ToUpper(rs.Rune())
 
 		switch r {
@@ -248,16 +576,26 @@ func ParseLine(line string) (*Block, error) {
 					break
 				}
 			}
-		case 'F', 'S':
+		case 'F', 'P':
+			{
+				cc = CodeCmd{Cmd: string(r), Type: ValueInt}
+				cc.Value, err = rs.GetValue(ValueFloat) // inch feeds and dwell seconds have decimals
+				if err != nil {
+					break
+				}
+				if cc.Value != math.Trunc(cc.Value) {
+					cc.Type = ValueFloat
+				}
+			}
+		case 'S', 'T', 'O', 'L':
 			{
 				cc = CodeCmd{Cmd: string(r), Type: ValueInt}
 				cc.Value, err = rs.GetValue(ValueInt)
 				if err != nil {
 					break
 				}
-				cc.Type = ValueInt
 			}
-		case 'X', 'Y', 'Z':
+		case 'X', 'Y', 'Z', 'I', 'J', 'K', 'R', 'Q', 'A', 'B', 'C', 'U', 'V', 'W':
 			{
 				cc = CodeCmd{Cmd: string(r), Type: ValueFloat}
 				cc.Value, err = rs.GetValue(ValueFloat)
@@ -265,13 +603,42 @@ func ParseLine(line string) (*Block, error) {
 					break
 				}
 			}
+		case 'N':
+			{
+				cc = CodeCmd{Cmd: string(r), Type: ValueInt}
+				cc.Value, err = rs.GetValue(ValueInt)
+				if err != nil {
+					break
+				}
+				if len(block.Cmds) > 0 { // only at the start of the line
+					err = errors.New("Invalid position for N")
+				} else if cc.Value < 0 {
+					err = errors.New("Negative line number")
+				}
+			}
+		case '*':
+			{
+				cc = CodeCmd{Cmd: string(r), Type: ValueInt}
+				cc.Value, err = rs.GetValue(ValueInt)
+				if err != nil {
+					break
+				}
+				if rest := strings.TrimSpace(string(rs.runes[rs.index:])); rest != "" && !strings.HasPrefix(rest, ";") { // but for a comment
+					err = errors.New("Checksum must end the line")
+					break
+				}
+				if sum := Checksum(string(rs.runes[:column-1])); int(cc.Value) != sum {
+					err = fmt.Errorf("Checksum mismatch, expected %d", sum)
+				}
+			}
 		case '/':
 			{
-				if rs.index != 1 { //rs.index is incremented
+				if len(block.Cmds) > 0 || block.BlockDelete { // only at the start of the line
 					err = errors.New("Invalid position for '/'")
 					break
 				}
-				cc = CodeCmd{Cmd: fmt.Sprintf("/%s", string(*rs.Until(false, ' '))), Type: Comment}
+				block.BlockDelete = true // the words after it are read as those of any block
+				continue
 			}
 		case ';':
 			{
@@ -283,21 +650,34 @@ func ParseLine(line string) (*Block, error) {
 			}
 		default:
 			{
+				if lenient && unicode.IsLetter(r) {
+					rs.ValueRunes()
+					cc = CodeCmd{Cmd: string(rs.runes[column-1 : rs.index]), Type: Opaque}
+					break
+				}
 				err = errors.New("Unexpected character " + string(r))
 				break
 			}
 		}
 
-		if !cc.Supported() {
-			err = errors.New(fmt.Sprintf("Unsuported command: %s", cc.String(true)))
+		cc.Column = column
+		cc.Source = string(rs.runes[column-1 : rs.index])
+		if err == nil && !cc.Supported() {
+			if lenient {
+				cc = CodeCmd{Cmd: cc.Source, Value: cc.Value, Type: Opaque, Column: column, Source: cc.Source}
+			} else {
+				err = errors.New("Unsuported command")
+			}
 		}
 		if err != nil {
-			break
+			return block, &ParseError{Column: column, Word: string(rs.runes[column-1 : rs.index]), Reason: err.Error()}
 		}
 		block.Cmds = append(block.Cmds, cc)
 	}
 	if err == nil {
 		err = block.Parse(true)
 	}
+	block.Source = line
+	block.sourceCmds = len(block.Cmds)
 	return block, err
 }
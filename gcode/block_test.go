@@ -11,11 +11,12 @@ import (
 func Test1ParseBlock(t *testing.T) {
 	passTests := map[string]struct {
 		cmd   string
-		value float32
+		value float64
 		ctype CmdType
 	}{
 		"%":     {cmd: "%", value: 0, ctype: Percent},
 		"F250":  {cmd: "F", value: 250, ctype: ValueInt},
+		"F12.5": {cmd: "F", value: 12.5, ctype: ValueFloat},
 		"G1":    {cmd: "G", value: 1, ctype: Address},
 		"G01":   {cmd: "G", value: 1, ctype: Address},
 		"S1000": {cmd: "S", value: 1000, ctype: ValueInt},
@@ -23,7 +24,31 @@ func Test1ParseBlock(t *testing.T) {
 		"X-1.1": {cmd: "X", value: -1.1, ctype: ValueFloat},
 		"Y-1.1": {cmd: "Y", value: -1.1, ctype: ValueFloat},
 		"Z1.1":  {cmd: "Z", value: 1.1, ctype: ValueFloat},
-		"/bla":  {cmd: "/bla", value: 0, ctype: Comment},
+		"G2":    {cmd: "G", value: 2, ctype: Address},
+		"G03":   {cmd: "G", value: 3, ctype: Address},
+		"G91":   {cmd: "G", value: 91, ctype: Address},
+		"G90.1": {cmd: "G", value: 90.1, ctype: Address},
+		"I-1.1": {cmd: "I", value: -1.1, ctype: ValueFloat},
+		"J1.1":  {cmd: "J", value: 1.1, ctype: ValueFloat},
+		"K0.5":  {cmd: "K", value: 0.5, ctype: ValueFloat},
+		"R2.5":  {cmd: "R", value: 2.5, ctype: ValueFloat},
+		"A90":   {cmd: "A", value: 90, ctype: ValueFloat},
+		"b-45":  {cmd: "B", value: -45, ctype: ValueFloat},
+		"C1.5":  {cmd: "C", value: 1.5, ctype: ValueFloat},
+		"U1":    {cmd: "U", value: 1, ctype: ValueFloat},
+		"V2":    {cmd: "V", value: 2, ctype: ValueFloat},
+		"W-3":   {cmd: "W", value: -3, ctype: ValueFloat},
+		"P0.5":  {cmd: "P", value: 0.5, ctype: ValueFloat},
+		"P2":    {cmd: "P", value: 2, ctype: ValueInt},
+		"G4":    {cmd: "G", value: 4, ctype: Address},
+		"G18":   {cmd: "G", value: 18, ctype: Address},
+		"G28":   {cmd: "G", value: 28, ctype: Address},
+		"G30.1": {cmd: "G", value: 30.1, ctype: Address},
+		"G80":   {cmd: "G", value: 80, ctype: Address},
+		"G93":   {cmd: "G", value: 93, ctype: Address},
+		"M1":    {cmd: "M", value: 1, ctype: Address},
+		"M8":    {cmd: "M", value: 8, ctype: Address},
+		"/G1":   {cmd: "G", value: 1, ctype: Address},
 	}
 
 	assert := assert.New(t)
@@ -107,7 +132,7 @@ func Test3ParseBlock(t *testing.T) {
 }
 
 func Test4ParseBlock(t *testing.T) {
-	_, err := ParseLine("G91")
+	_, err := ParseLine("G64")
 	require.NotEmpty(t, err, "Failed to reject unsuported command")
 }
 
@@ -152,15 +177,17 @@ func Test7ParseBlock(t *testing.T) {
 	block.Init()
 
 	//check against nil
-	assert.True(block.NoChangeY(2.0))
-	assert.True(block.NoChangeZ(3.0))
+	assert.True(block.NoChangeY(2.0, DefaultTolerance))
+	assert.True(block.NoChangeZ(3.0, DefaultTolerance))
 
 	block.SetY(2.0)
 	block.SetZ(3.0)
-	assert.True(block.NoChangeY(2.0))
-	assert.True(block.NoChangeZ(3.0))
-	assert.False(block.NoChangeY(2.1))
-	assert.False(block.NoChangeZ(3.1))
+	assert.True(block.NoChangeY(2.0, DefaultTolerance))
+	assert.True(block.NoChangeZ(3.0, DefaultTolerance))
+	assert.False(block.NoChangeY(2.1, DefaultTolerance))
+	assert.False(block.NoChangeZ(3.1, DefaultTolerance))
+	assert.True(block.NoChangeZ(3.0000001, DefaultTolerance))
+	assert.False(block.NoChangeZ(3.0000001, 0))
 
 	assert.Empty(block.G)
 	block.SetG(0)
@@ -177,15 +204,17 @@ func Test9ParseBlock(t *testing.T) { // ToStep
 	assert := assert.New(t)
 
 	tests := map[string]struct {
-		X       float32
-		Y       float32
-		Z       float32
-		inc     float32
-		minCut  float32
+		X       float64
+		Y       float64
+		Z       float64
+		inc     float64
+		minCut  float64
 		pass    int
-		safe    float32
+		safe    float64
+		top     float64
+		depths  []float64
 		isC     bool
-		expZ    float32
+		expZ    float64
 		expPass int
 	}{
 		"pass 1 Z = 0":        {X: 1.0, Y: 2.0, Z: 0, inc: -3.0, minCut: 0.5, pass: 1, safe: 5.0, isC: false, expZ: 0, expPass: 0},
@@ -195,6 +224,13 @@ func Test9ParseBlock(t *testing.T) { // ToStep
 		"pass 1 very shallow": {X: 1.0, Y: 2.0, Z: -2.0, inc: -3.0, minCut: 0.5, pass: 1, safe: 5.0, isC: true, expZ: 0.5, expPass: 0},
 		"pass 2 shallow":      {X: 1.0, Y: 2.0, Z: -4.0, inc: -3.0, minCut: 0.5, pass: 2, safe: 5.0, isC: true, expZ: -2.5, expPass: 1},
 		"pass 2 deep":         {X: 1.0, Y: 2.0, Z: -7.0, inc: -3.0, minCut: 0.5, pass: 2, safe: 5.0, isC: true, expZ: -5.5, expPass: 2},
+		"radius above":        {X: 1.0, Y: 2.0, Z: 21.0, inc: -3.0, minCut: 0.5, pass: 1, safe: 5.0, top: 20, isC: false, expZ: 21.0, expPass: 0},
+		"radius pass 1 deep":  {X: 1.0, Y: 2.0, Z: 14.0, inc: -3.0, minCut: 0.5, pass: 1, safe: 5.0, top: 20, isC: true, expZ: 17.5, expPass: 1},
+		"radius pass 2 deep":  {X: 1.0, Y: 2.0, Z: 12.0, inc: -3.0, minCut: 0.5, pass: 2, safe: 5.0, top: 20, isC: true, expZ: 14.5, expPass: 2},
+		"depths pass 1":       {X: 1.0, Y: 2.0, Z: -8.0, inc: -1.0, minCut: 0.5, pass: 1, safe: 5.0, depths: []float64{-4, -7}, isC: true, expZ: -3.5, expPass: 2},
+		"depths pass 2":       {X: 1.0, Y: 2.0, Z: -8.0, inc: -1.0, minCut: 0.5, pass: 2, safe: 5.0, depths: []float64{-4, -7}, isC: true, expZ: -6.5, expPass: 2},
+		"depths shallow":      {X: 1.0, Y: 2.0, Z: -5.0, inc: -1.0, minCut: 0.5, pass: 2, safe: 5.0, depths: []float64{-4, -7}, isC: true, expZ: -3.5, expPass: 1},
+		"after depths":        {X: 1.0, Y: 2.0, Z: -9.5, inc: -1.0, minCut: 0.5, pass: 4, safe: 5.0, depths: []float64{-4, -7}, isC: true, expZ: -8.5, expPass: 4},
 	}
 
 	t.Run("Nil Z", func(t *testing.T) {
@@ -214,7 +250,7 @@ func Test9ParseBlock(t *testing.T) { // ToStep
 			b.SetX(tc.X)
 			b.SetY(tc.Y)
 			b.SetZ(tc.Z)
-			info := Info{Increment: tc.inc, MinCut: tc.minCut, SkipHeight: tc.safe}
+			info := Info{Increment: tc.inc, MinCut: tc.minCut, SkipHeight: tc.safe, Top: tc.top, Depths: tc.depths}
 			b.ToStepZ(&info, tc.pass)
 			assert.EqualValues(tc.isC, b.IsClamped, "IsClamped")
 			assert.EqualValues(tc.expZ, (*b.Z).Value, "Value")
@@ -235,4 +271,38 @@ func Test10ParseBlock(t *testing.T) { // Reposition
 	b.Reposition(10.0, 20.0)
 	assert.EqualValues(11.0, b.X.Value)
 	assert.EqualValues(22.0, b.Y.Value)
+
+	home, err := ParseLine("G28 X1 Z5")
+	require.NoError(t, err)
+	home.State.Distance = Absolute
+	home.Reposition(10.0, 20.0)
+	assert.EqualValues("G28X11Z5", home.String(false, false), "the intermediate point moves with the data")
+
+	home, err = ParseLine("G91 G28 X0")
+	require.NoError(t, err)
+	home.State.Distance = Incremental
+	home.Reposition(10.0, 20.0)
+	assert.EqualValues("G91 G28 X0", home.String(false, false), "an incremental point stays relative")
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	line := "G00 X-1.500 y2 (move)"
+	b, err := ParseLine(line)
+	require.Empty(t, err)
+	assert.True(b.Unchanged())
+	assert.EqualValues(line+"\n", b.String(true, false))
+	assert.EqualValues("G00 X-1.500 Y2.000 (move) ", b.String(false, true), "pretty reformats")
+
+	c := b.Copy()
+	assert.EqualValues(line, c.String(false, false), "copy")
+
+	c.SetZ(5)
+	assert.False(c.Unchanged())
+	assert.EqualValues("G00X-1.500y2(move)Z5", c.String(false, false), "unchanged words kept")
+
+	b.State.Distance = Absolute
+	b.Reposition(1, 0)
+	assert.EqualValues("G00X-0.5y2(move)", b.String(false, false))
 }
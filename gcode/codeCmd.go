@@ -2,6 +2,7 @@ package gcode
 
 import (
 	"fmt"
+	"math"
 	"strings"
 )
 
@@ -13,18 +14,39 @@ const (
 	ValueInt
 	Comment
 	Percent
+	Opaque // unrecognised word kept verbatim in Cmd by lenient parsing
 )
 
 type CodeCmd struct {
-	Cmd   string
-	Value float32
-	Type  CmdType
+	Cmd    string
+	Value  float64
+	Type   CmdType
+	Column int    // rune column in the parsed line, 0 if not parsed
+	Source string // text of the word as parsed, empty if created or changed
+}
+
+// Sets the value, the source text no longer matches so it is cleared.
+func (c *CodeCmd) SetValue(value float64) {
+	c.Value = value
+	c.Source = ""
 }
 
 func (c CodeCmd) String(pretty bool) string {
+	return c.Format(pretty, 3)
+}
+
+// Formats the command with decimals places for float values.
+// The source text is returned unchanged if it is known and not pretty.
+func (c CodeCmd) Format(pretty bool, decimals int) string {
+	if !pretty && c.Source != "" {
+		return c.Source
+	}
 	switch c.Type {
 	case Address:
 		{
+			if c.Value != math.Trunc(c.Value) {
+				return fmt.Sprintf("%s%.1f", c.Cmd, c.Value)
+			}
 			if pretty {
 				return fmt.Sprintf("%s%02.0f", c.Cmd, c.Value)
 			} else {
@@ -34,9 +56,9 @@ func (c CodeCmd) String(pretty bool) string {
 	case ValueFloat:
 		{
 			if pretty {
-				return fmt.Sprintf("%s%.3f", c.Cmd, c.Value)
+				return fmt.Sprintf("%s%.*f", c.Cmd, decimals, c.Value)
 			} else {
-				return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%s%.3f", c.Cmd, c.Value), "0"), ".")
+				return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%s%.*f", c.Cmd, decimals, c.Value), "0"), ".")
 			}
 		}
 	case ValueInt:
@@ -48,19 +70,39 @@ func (c CodeCmd) String(pretty bool) string {
 	return c.Cmd
 }
 
+// Returns the name an unrecognised word is summarised by, the code for G and M, otherwise the letter.
+func (c CodeCmd) Unrecognised() string {
+	letter := strings.ToUpper(c.Cmd[:1])
+	if letter == "G" || letter == "M" {
+		return CodeCmd{Cmd: letter, Value: c.Value, Type: Address}.String(false)
+	}
+	return letter
+}
+
+// True if the command is an unsupported G or M code kept by lenient parsing.
+func (c CodeCmd) IsOpaqueCode() bool {
+	if c.Type != Opaque || len(c.Cmd) < 2 {
+		return false
+	}
+	letter := strings.ToUpper(c.Cmd[:1])
+	return letter == "G" || letter == "M"
+}
+
 func (c CodeCmd) Supported() bool {
-	if c.Type == Percent || c.Type == Comment {
+	if c.Type == Percent || c.Type == Comment || c.Type == Opaque {
 		return true
 	}
 	switch c.Cmd {
-	case "F", "S", "X", "Y", "Z":
+	case "F", "P", "S", "T", "O", "L", "N", "*", "X", "Y", "Z", "I", "J", "K", "R", "Q", "A", "B", "C", "U", "V", "W":
 		{
 			return true
 		}
 	case "G":
 		{
 			switch c.Value {
-			case 0, 1, 20, 21, 90:
+			case 0, 1, 2, 3, 4, 17, 18, 19, 20, 21, 28, 28.1, 30, 30.1, 40, 49, 73, 80, 81, 82, 83,
+				90, 90.1, 91, 91.1, 93, 94, 98, 99,
+				54, 55, 56, 57, 58, 59, 59.1, 59.2, 59.3, 92, 92.1, 92.2, 92.3:
 				{
 					return true
 				}
@@ -69,7 +111,7 @@ func (c CodeCmd) Supported() bool {
 	case "M":
 		{
 			switch c.Value {
-			case 3, 5, 30:
+			case 0, 1, 3, 4, 5, 6, 7, 8, 9, 30, 98, 99:
 				{
 					return true
 				}
@@ -12,7 +12,7 @@ func TestCodeCmd(t *testing.T) {
 	t.Run("String", func(t *testing.T) {
 		passTests := map[string]struct {
 			cmd    string
-			value  float32
+			value  float64
 			ctype  CmdType
 			pretty bool
 			result string
@@ -20,12 +20,14 @@ func TestCodeCmd(t *testing.T) {
 			"%":            {cmd: "%", value: 0, ctype: Percent, pretty: false, result: "%"},
 			"F250":         {cmd: "F", value: 250, ctype: ValueInt, pretty: false, result: "F250"},
 			"G1":           {cmd: "G", value: 1, ctype: Address, pretty: false, result: "G1"},
+			"G90.1":        {cmd: "G", value: 90.1, ctype: Address, pretty: false, result: "G90.1"},
 			"X-1.1":        {cmd: "X", value: -1.1, ctype: ValueFloat, pretty: false, result: "X-1.1"},
 			"X-1.0":        {cmd: "X", value: -1.0, ctype: ValueFloat, pretty: false, result: "X-1"},
 			"/bla":         {cmd: "/bla", value: 0, ctype: Comment, pretty: false, result: "/bla"},
 			"pretty %":     {cmd: "%", value: 0, ctype: Percent, pretty: true, result: "%"},
 			"pretty F250":  {cmd: "F", value: 250, ctype: ValueInt, pretty: true, result: "F250"},
 			"pretty G1":    {cmd: "G", value: 1, ctype: Address, pretty: true, result: "G01"},
+			"pretty G91.1": {cmd: "G", value: 91.1, ctype: Address, pretty: true, result: "G91.1"},
 			"pretty X-1.1": {cmd: "X", value: -1.1, ctype: ValueFloat, pretty: true, result: "X-1.100"},
 			"pretty X-1.0": {cmd: "X", value: -1.0, ctype: ValueFloat, pretty: true, result: "X-1.000"},
 			"pretty /bla":  {cmd: "/bla", value: 0, ctype: Comment, pretty: true, result: "/bla"},
@@ -0,0 +1,247 @@
+// cycle
+package gcode
+
+import (
+	"fmt"
+	"math"
+)
+
+// Clearance of G73 chip breaking retracts and of G83 rapids back down to the last peck.
+const (
+	PeckClearanceMM   = 0.254
+	PeckClearanceInch = 0.01
+)
+
+// True if the code selects a canned drilling cycle.
+func isCycle(code float64) bool {
+	return code == 73 || code == 81 || code == 82 || code == 83
+}
+
+// True if any block starts a canned drilling cycle.
+func (bs Blocks) HasCannedCycles() bool {
+	for _, block := range bs {
+		if block.cycle() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the G word of the block starting a canned cycle, nil if it has none.
+func (b *Block) cycle() *CodeCmd {
+	for i, cmd := range b.Cmds {
+		if cmd.Cmd == "G" && isCycle(cmd.Value) {
+			return &b.Cmds[i]
+		}
+	}
+	return nil
+}
+
+// Words of a cycle that stay set until the cycle is cancelled.
+type cycleState struct {
+	code     *CodeCmd // nil when no cycle is active
+	r        float64
+	z        float64
+	q        float64
+	p        float64
+	retractR bool // G99 retracts to R, G98 to the level before the cycle
+}
+
+type cycleExpander struct {
+	state  State
+	cycle  cycleState
+	result Blocks
+}
+
+// Adds a block with the G code and words, the Line of the block is that of the source.
+func (ce *cycleExpander) emit(source *Block, code float64, axes ...CodeCmd) {
+	block := new(Block)
+	block.Cmds = append([]CodeCmd{{Cmd: "G", Value: code, Type: Address}}, axes...)
+	ce.add(source, block)
+}
+
+func (ce *cycleExpander) add(source *Block, block *Block) {
+	block.Parse(false)
+	block.Line = source.Line
+	block.Start = ce.state.Position
+	ce.state.Update(block)
+	block.State = ce.state
+	ce.result = append(ce.result, block)
+}
+
+func axisWord(axis string, value float64) CodeCmd {
+	return CodeCmd{Cmd: axis, Value: value, Type: ValueFloat}
+}
+
+// Returns the blocks with canned drilling cycles replaced by G0/G1 moves, so that they are stepped down
+// by the passes like any other cut. G81 drills, G82 dwells for P at the bottom, G83 pecks by Q retracting
+// to R and G73 pecks by Q with a short retract to break the chip. G98 and G99 select the retract level.
+// In G91 R is from the start level and Z from R, and L repeats the hole at the X/Y increment.
+// A cycle is repeated by blocks with axis words until G80 or another motion code.
+func (bs Blocks) ExpandCycles() (Blocks, error) {
+	ce := cycleExpander{state: NewState(), result: make(Blocks, 0, len(bs))}
+	for _, block := range bs {
+		if err := ce.expand(block); err != nil {
+			return ce.result, err
+		}
+	}
+	return ce.result, nil
+}
+
+func (ce *cycleExpander) expand(block *Block) error {
+	fail := func(cmd *CodeCmd, reason string) error {
+		pe := newParseError(cmd, reason)
+		pe.Line = block.Line
+		return pe
+	}
+	for _, cmd := range block.Cmds {
+		if cmd.Cmd != "G" {
+			continue
+		}
+		switch {
+		case cmd.Value == 98:
+			ce.cycle.retractR = false
+		case cmd.Value == 99:
+			ce.cycle.retractR = true
+		case cmd.Value <= 3 || cmd.Value == 80:
+			ce.cycle.code = nil
+		}
+	}
+	code := block.cycle()
+	if code != nil {
+		ce.cycle.code = code
+	}
+	if ce.cycle.code == nil || (code == nil && !block.IsMove() && block.word("R") == nil) {
+		c := block.Copy()
+		ce.add(block, &c)
+		return nil
+	}
+	if block.IsAuxiliaryMove() {
+		return fail(ce.cycle.code, "Canned cycles cannot move rotary or auxiliary axes")
+	}
+
+	rest := Block{Cmds: make([]CodeCmd, 0, len(block.Cmds))} // words that are not part of the cycle are kept before the moves
+	for _, cmd := range block.Cmds {
+		switch cmd.Cmd {
+		case "G":
+			if isCycle(cmd.Value) {
+				continue
+			}
+		case "X", "Y", "Z", "R", "Q", "P", "L":
+			continue
+		}
+		rest.Cmds = append(rest.Cmds, cmd)
+	}
+	if len(rest.Cmds) > 0 {
+		ce.add(block, &rest)
+	}
+	if ce.state.Plane != PlaneXY {
+		return fail(ce.cycle.code, "Canned cycles are only supported in the XY plane")
+	}
+	if !ce.state.KnownZ {
+		return fail(ce.cycle.code, "Canned cycle from an unknown Z")
+	}
+	incremental := ce.state.Distance == Incremental
+	start := ce.state.Position.Z
+	if r := block.word("R"); r != nil {
+		ce.cycle.r = r.Value
+		if incremental {
+			ce.cycle.r += start
+		}
+	}
+	if block.Z != nil {
+		ce.cycle.z = block.Z.Value
+		if incremental {
+			ce.cycle.z += ce.cycle.r
+		}
+	}
+	if q := block.word("Q"); q != nil {
+		ce.cycle.q = q.Value
+	}
+	if p := block.word("P"); p != nil {
+		ce.cycle.p = p.Value
+	}
+	if ce.cycle.z > ce.cycle.r {
+		return fail(ce.cycle.code, "Canned cycle Z above R")
+	}
+	peck := ce.cycle.code.Value == 73 || ce.cycle.code.Value == 83
+	if peck && ce.cycle.q <= 0 {
+		return fail(ce.cycle.code, fmt.Sprintf("G%.0f needs a positive Q", ce.cycle.code.Value))
+	}
+	repeats := 1
+	if l := block.word("L"); l != nil {
+		repeats = int(l.Value)
+	}
+
+	if incremental { // the moves are absolute
+		ce.add(block, &Block{Cmds: []CodeCmd{{Cmd: "G", Value: 90, Type: Address}}})
+	}
+	x, y := ce.state.Position.X, ce.state.Position.Y
+	for i := 0; i < repeats; i++ {
+		if block.X != nil {
+			x = cycleAxis(x, block.X.Value, incremental)
+		}
+		if block.Y != nil {
+			y = cycleAxis(y, block.Y.Value, incremental)
+		}
+		ce.hole(block, x, y, start)
+	}
+	if incremental {
+		ce.add(block, &Block{Cmds: []CodeCmd{{Cmd: "G", Value: 91, Type: Address}}})
+	}
+	return nil
+}
+
+// Returns the position of an axis word, incremental words are added to the position.
+func cycleAxis(position float64, value float64, incremental bool) float64 {
+	if incremental {
+		return position + value
+	}
+	return value
+}
+
+// Drills one hole at X/Y from the level start.
+func (ce *cycleExpander) hole(source *Block, x float64, y float64, start float64) {
+	c := ce.cycle
+	clearance := PeckClearanceMM
+	if ce.state.Units == Inches {
+		clearance = PeckClearanceInch
+	}
+	if ce.state.Position.Z < c.r {
+		ce.emit(source, 0, axisWord("Z", c.r))
+	}
+	ce.emit(source, 0, axisWord("X", x), axisWord("Y", y))
+	if ce.state.Position.Z != c.r {
+		ce.emit(source, 0, axisWord("Z", c.r))
+	}
+
+	switch c.code.Value {
+	case 81, 82:
+		{
+			ce.emit(source, 1, axisWord("Z", c.z))
+			if c.code.Value == 82 && c.p > 0 {
+				ce.emit(source, 4, CodeCmd{Cmd: "P", Value: c.p, Type: ValueFloat})
+			}
+		}
+	case 73, 83:
+		{
+			depth := c.r
+			for depth > c.z {
+				if depth < c.r {
+					if c.code.Value == 83 {
+						ce.emit(source, 0, axisWord("Z", c.r))
+					}
+					ce.emit(source, 0, axisWord("Z", depth+clearance))
+				}
+				depth = math.Max(depth-c.q, c.z)
+				ce.emit(source, 1, axisWord("Z", depth))
+			}
+		}
+	}
+
+	retract := c.r
+	if !c.retractR && start > retract {
+		retract = start
+	}
+	ce.emit(source, 0, axisWord("Z", retract))
+}
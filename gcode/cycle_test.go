@@ -0,0 +1,69 @@
+package gcode
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandCycles(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		program string
+		want    []string
+	}{
+		"Drill": {
+			program: "G0 Z10\nG81 X1 Y2 Z-5 R2 F100\nX3\nG80\nG0 X0",
+			want: []string{"G0 Z10", "F100", "G0X1Y2", "G0Z2", "G1Z-5", "G0Z10",
+				"G0X3Y2", "G0Z2", "G1Z-5", "G0Z10", "G80", "G0 X0"},
+		},
+		"Retract to R and dwell": {
+			program: "G0 Z10\nG99 G82 X1 Y2 Z-5 R2 P0.5",
+			want:    []string{"G0 Z10", "G99", "G0X1Y2", "G0Z2", "G1Z-5", "G4P0.5", "G0Z2"},
+		},
+		"Below R": {
+			program: "G0 Z1\nG81 X1 Y2 Z-5 R2",
+			want:    []string{"G0 Z1", "G0Z2", "G0X1Y2", "G1Z-5", "G0Z2"},
+		},
+		"Peck": {
+			program: "G0 Z5\nG83 X0 Y0 Z-5 R1 Q3",
+			want: []string{"G0 Z5", "G0X0Y0", "G0Z1", "G1Z-2", "G0Z1", "G0Z-1.746", "G1Z-5",
+				"G0Z5"},
+		},
+		"Chip break": {
+			program: "G0 Z5\nG73 X0 Y0 Z-5 R1 Q3",
+			want:    []string{"G0 Z5", "G0X0Y0", "G0Z1", "G1Z-2", "G0Z-1.746", "G1Z-5", "G0Z5"},
+		},
+		"Incremental": {
+			program: "G0 X1 Y1 Z5\nG91 G81 X2 Z-3 R-4 L2",
+			want: []string{"G0 X1 Y1 Z5", "G91", "G90", "G0X3Y1", "G0Z1", "G1Z-2", "G0Z5",
+				"G0X5Y1", "G0Z1", "G1Z-2", "G0Z5", "G91"},
+		},
+	}
+	for name, tc := range tests {
+		got, err := readProgram(t, tc.program).ExpandCycles()
+		require.Empty(t, err, name)
+		assert.EqualValues(tc.want, blockStrings(got), name)
+	}
+
+	got, err := readProgram(t, "G0 Z5\nG81 X1 Y2 Z-5 R2").ExpandCycles()
+	require.Empty(t, err)
+	assert.EqualValues(2, got[len(got)-1].Line, "source line of the moves")
+	assert.EqualValues(Point{X: 1, Y: 2, Z: 5}, got[len(got)-1].State.Position)
+
+	tests2 := map[string]string{
+		"Unknown Z": "G81 X1 Y2 Z-5 R2",
+		"No Q":      "G0 Z5\nG83 X1 Y2 Z-5 R2",
+		"Z above R": "G0 Z5\nG81 X1 Y2 Z3 R2",
+		"Plane":     "G0 Z5\nG18 G81 X1 Y2 Z-5 R2",
+	}
+	for name, program := range tests2 {
+		_, err := readProgram(t, program).ExpandCycles()
+		var pe *ParseError
+		assert.True(errors.As(err, &pe), name)
+	}
+}
@@ -0,0 +1,125 @@
+// entry
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Most back and forth legs of a ramp, a ramp needing more plunges instead.
+const MaxRampLegs = 10
+
+// Entry is how the tool goes down into the stock from the skip height.
+type Entry int
+
+const (
+	Plunge Entry = iota
+	Ramp         // back and forth along the next cut
+	Helix        // circling down
+)
+
+func (e Entry) String() string {
+	switch e {
+	case Ramp:
+		return "ramp"
+	case Helix:
+		return "helix"
+	}
+	return "plunge"
+}
+
+// Returns the entry with the name, as returned by String.
+func ParseEntry(name string) (Entry, error) {
+	for _, e := range []Entry{Plunge, Ramp, Helix} {
+		if strings.EqualFold(name, e.String()) {
+			return e, nil
+		}
+	}
+	return Plunge, fmt.Errorf("Unknown entry %s", name)
+}
+
+// Returns the feed of the cuts in the state, FeedRate if it overrides the feed of the program.
+func (i *Info) CutFeed(state *State) float64 {
+	if i.FeedRate > 0 {
+		return i.FeedRate
+	}
+	return state.Feed
+}
+
+// Returns the moves at the feed from the skip height at Z height down to the position of from, before the move
+// from it to the position of to. The feed of from is the one in effect, the first move sets the feed if it differs.
+// A ramp runs back and forth along the move, descending at most EntryAngle, and needs a straight move that does
+// not rise or turn an axis other than X, Y and Z. A helix circles counterclockwise on HelixRadius about a point
+// ahead on the move, descending at most EntryAngle, and needs the XY plane and a surface with room to leave
+// MinCut of it. Nil is returned to plunge if the entry does not fit.
+func (i *Info) EntryMoves(from *State, to *State, height float64, feed float64) Blocks {
+	drop := height - from.Position.Z
+	if i.Entry == Plunge || drop <= i.Tolerance || from.InverseTime {
+		return nil
+	}
+	slope := math.Tan(i.EntryAngle * math.Pi / 180)
+	dx, dy := to.Position.X-from.Position.X, to.Position.Y-from.Position.Y
+	length := math.Hypot(dx, dy)
+
+	state := *from
+	state.Distance = Absolute
+	state.Motion = Rapid
+	state.Position.Z = height
+	r := roughing{state: state, blocks: make(Blocks, 0), feed: feed}
+	x, y := from.Position.X, from.Position.Y
+
+	switch i.Entry {
+	case Ramp:
+		{
+			if to.Motion != Linear || length <= i.Tolerance || to.Position.Z > from.Position.Z+i.Tolerance || !to.Aux.Near(&from.Aux, i.Tolerance) {
+				return nil
+			}
+			legs := 2 * int(math.Ceil(drop/(2*length*slope)-DefaultTolerance)) // ending back at the start
+			if legs > MaxRampLegs {
+				return nil
+			}
+			reach := drop / (float64(legs) * slope)
+			farX, farY := x+dx/length*reach, y+dy/length*reach
+			for leg := 1; leg <= legs; leg++ {
+				z := height - drop*float64(leg)/float64(legs)
+				if leg%2 == 1 {
+					r.emit(1, axisWord("X", farX), axisWord("Y", farY), axisWord("Z", z))
+				} else {
+					r.emit(1, axisWord("X", x), axisWord("Y", y), axisWord("Z", z))
+				}
+			}
+		}
+	case Helix:
+		{
+			if from.Plane != PlaneXY || i.HelixRadius <= i.Tolerance || i.Surface == nil { // no room without a surface
+				return nil
+			}
+			ux, uy := 1.0, 0.0 // along X if the move has no direction
+			if length > i.Tolerance {
+				ux, uy = dx/length, dy/length
+			}
+			cx, cy := x+ux*i.HelixRadius, y+uy*i.HelixRadius
+			shift := i.Shift(from)
+			steps := int(math.Ceil(2*math.Pi*i.HelixRadius/(i.Surface.Cell/2))) + 1
+			for j := 0; j < steps; j++ {
+				angle := 2 * math.Pi * float64(j) / float64(steps)
+				px := cx + i.HelixRadius*math.Cos(angle) + shift.X
+				py := cy + i.HelixRadius*math.Sin(angle) + shift.Y
+				if i.Clearance(px, py) > from.Position.Z+shift.Z+i.Tolerance {
+					return nil
+				}
+			}
+			ci, cj := cx-x, cy-y
+			if from.ArcIJK { // absolute centers
+				ci, cj = cx, cy
+			}
+			turns := int(math.Ceil(drop/(2*math.Pi*i.HelixRadius*slope) - DefaultTolerance))
+			for turn := 1; turn <= turns; turn++ {
+				z := height - drop*float64(turn)/float64(turns)
+				r.emit(3, axisWord("X", x), axisWord("Y", y), axisWord("Z", z), axisWord("I", ci), axisWord("J", cj))
+			}
+		}
+	}
+	return r.blocks
+}
@@ -0,0 +1,83 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryMoves(t *testing.T) {
+	assert := assert.New(t)
+
+	from := NewState()
+	from.Position = Point{X: 0, Y: 0, Z: -2}
+	from.Feed = 500
+	tests := map[string]struct {
+		entry   Entry
+		to      Point
+		arc     bool
+		surface bool
+		moves   int // 0 to plunge
+	}{
+		"Plunge":         {entry: Plunge, to: Point{X: 40, Z: -2}, moves: 0},
+		"Ramp":           {entry: Ramp, to: Point{X: 40, Z: -2}, moves: 2},
+		"Ramp diagonal":  {entry: Ramp, to: Point{X: 24, Y: -32, Z: -3}, moves: 2},
+		"Ramp more legs": {entry: Ramp, to: Point{X: 15, Z: -2}, moves: 4},
+		"Ramp too short": {entry: Ramp, to: Point{X: 5, Z: -2}, moves: 0},
+		"Ramp rising":    {entry: Ramp, to: Point{X: 40, Z: 0}, moves: 0},
+		"Ramp arc":       {entry: Ramp, to: Point{X: 40, Z: -2}, arc: true, moves: 0},
+		"Helix":          {entry: Helix, to: Point{X: 40, Z: -2}, surface: true, moves: 10},
+		"Helix arc":      {entry: Helix, to: Point{X: 5, Z: -2}, arc: true, surface: true, moves: 10},
+		"Helix no room":  {entry: Helix, to: Point{X: 40, Z: -2}, moves: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			info := Info{Entry: tc.entry, EntryAngle: 3, HelixRadius: 1, MinCut: 0.5, Tolerance: DefaultTolerance, Start: NewState()}
+			if tc.surface { // a floor at Z-10
+				info.Init()
+				info.X.Update(-5)
+				info.X.Update(45)
+				info.Y.Update(-35)
+				info.Y.Update(5)
+				require.NoError(t, info.NewSurface(Tool{Shape: FlatEnd, Diameter: 1}, 0.25))
+				for i := range info.Surface.Z {
+					info.Surface.Z[i] = -10
+				}
+			}
+			to := from
+			to.Position = tc.to
+			to.Motion = Linear
+			if tc.arc {
+				to.Motion = ArcCCW
+			}
+			moves := info.EntryMoves(&from, &to, 1, 200)
+			if tc.moves == 0 {
+				assert.Nil(moves)
+				return
+			}
+			require.Len(t, moves, tc.moves)
+			assert.EqualValues(200, moves[0].F.Value, "at the entry feed")
+			end := moves[len(moves)-1].State.Position
+			assert.InDelta(0, end.X, 1e-9, "back at the start")
+			assert.InDelta(0, end.Y, 1e-9)
+			assert.InDelta(-2, end.Z, 1e-9)
+			for _, move := range moves {
+				run := math.Hypot(move.State.Position.X-move.Start.X, move.State.Position.Y-move.Start.Y)
+				if move.IsArc() {
+					run = 2 * math.Pi * info.HelixRadius
+				}
+				angle := math.Atan2(move.Start.Z-move.State.Position.Z, run) * 180 / math.Pi
+				assert.LessOrEqual(angle, info.EntryAngle+1e-9, "no steeper than the entry angle")
+			}
+		})
+	}
+
+	entry, err := ParseEntry("Helix")
+	assert.NoError(err)
+	assert.EqualValues(Helix, entry)
+	_, err = ParseEntry("spiral")
+	assert.Error(err)
+}
@@ -0,0 +1,453 @@
+// expand
+package gcode
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Line is a line of text with its line number in the source, starting at 1.
+type Line struct {
+	Text   string
+	Number int
+}
+
+// Limit on the lines produced by expanding a program, to stop runaway loops.
+const MaxExpandedLines = 1000000
+
+type flow int
+
+const (
+	flowNext flow = iota
+	flowBreak
+	flowContinue
+	flowReturn
+)
+
+// oWord is a parsed O-word line, e.g. "o100 while [#1 LT 10]".
+type oWord struct {
+	Name    string // number or <name> in lower case
+	Keyword string // in lower case
+	Args    []float64
+	Column  int
+}
+
+// Expander evaluates LinuxCNC parameters, expressions and O-word control flow into concrete lines.
+// Numbered parameters #1 to #30 and named parameters that do not start with '_' are local to a subroutine call.
+type Expander struct {
+	lines  []Line
+	words  []*oWord // parsed O-word of each line, nil if the line has none
+	subs   map[string]int
+	global map[string]float64
+	scopes []map[string]float64
+	output []Line
+}
+
+func NewExpander(lines []Line) *Expander {
+	return &Expander{
+		lines:  lines,
+		subs:   make(map[string]int),
+		global: make(map[string]float64),
+		scopes: []map[string]float64{make(map[string]float64)},
+		output: make([]Line, 0),
+	}
+}
+
+// True if the parameter is local to a subroutine call.
+func isLocal(name string) bool {
+	if strings.HasPrefix(name, "<") {
+		return !strings.HasPrefix(name, "<_")
+	}
+	number, _ := strconv.Atoi(name)
+	return number <= 30
+}
+
+func (e *Expander) scope(name string) map[string]float64 {
+	if isLocal(name) {
+		return e.scopes[len(e.scopes)-1]
+	}
+	return e.global
+}
+
+// Returns the value of the parameter, numbered parameters default to zero.
+func (e *Expander) Get(name string) (float64, error) {
+	if value, ok := e.scope(name)[name]; ok {
+		return value, nil
+	}
+	if strings.HasPrefix(name, "<") {
+		return 0, fmt.Errorf("Parameter #%s is not defined", name)
+	}
+	return 0, nil
+}
+
+func (e *Expander) Exists(name string) bool {
+	_, ok := e.scope(name)[name]
+	return ok
+}
+
+func (e *Expander) set(name string, value float64) {
+	e.scope(name)[name] = value
+}
+
+// Expands the lines, the result has the line number of the source line of each line.
+func (e *Expander) Expand() ([]Line, error) {
+	e.words = make([]*oWord, len(e.lines))
+	for i, line := range e.lines {
+		word, err := e.parseOWord(line.Text, false)
+		if err != nil {
+			return e.output, e.error(i, err)
+		}
+		e.words[i] = word
+		if word != nil && word.Keyword == "sub" {
+			e.subs[word.Name] = i
+		}
+	}
+	_, err := e.run(0, len(e.lines))
+	return e.output, err
+}
+
+func (e *Expander) error(index int, err error) error {
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		pe = &ParseError{Column: 1, Reason: err.Error()}
+	}
+	pe.Line = e.lines[index].Number
+	return pe
+}
+
+// Returns the index of the next line from start with the O-word name and one of the keywords, -1 if there is none.
+func (e *Expander) find(start int, name string, keywords ...string) int {
+	for i := start; i < len(e.words); i++ {
+		word := e.words[i]
+		if word == nil || word.Name != name {
+			continue
+		}
+		for _, keyword := range keywords {
+			if word.Keyword == keyword {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Executes the lines from start up to end.
+func (e *Expander) run(start int, end int) (flow, error) {
+	for i := start; i < end; i++ {
+		word := e.words[i]
+		if word == nil {
+			if err := e.expandLine(i); err != nil {
+				return flowNext, err
+			}
+			continue
+		}
+		word, err := e.parseOWord(e.lines[i].Text, true) // the arguments are evaluated when run
+		if err != nil {
+			return flowNext, e.error(i, err)
+		}
+
+		switch word.Keyword {
+		case "sub":
+			{
+				next := e.find(i+1, word.Name, "endsub")
+				if next < 0 {
+					return flowNext, e.error(i, errors.New("sub without endsub"))
+				}
+				i = next
+			}
+		case "call":
+			{
+				if err := e.call(i, word); err != nil {
+					return flowNext, err
+				}
+			}
+		case "return", "endsub":
+			{
+				if len(word.Args) > 0 {
+					e.global["<_value>"] = word.Args[0]
+				}
+				return flowReturn, nil
+			}
+		case "if":
+			{
+				endif := e.find(i+1, word.Name, "endif")
+				if endif < 0 {
+					return flowNext, e.error(i, errors.New("if without endif"))
+				}
+				f, err := e.branch(i, endif, word)
+				if err != nil || f != flowNext {
+					return f, err
+				}
+				i = endif
+			}
+		case "while", "do", "repeat":
+			{
+				closing := map[string]string{"while": "endwhile", "do": "while", "repeat": "endrepeat"}[word.Keyword]
+				next := e.find(i+1, word.Name, closing)
+				if next < 0 {
+					return flowNext, e.error(i, fmt.Errorf("%s without %s", word.Keyword, closing))
+				}
+				f, err := e.loop(i, next, word)
+				if err != nil || f == flowReturn {
+					return f, err
+				}
+				i = next
+			}
+		case "break":
+			return flowBreak, nil
+		case "continue":
+			return flowContinue, nil
+		default:
+			return flowNext, e.error(i, fmt.Errorf("Unexpected o%s %s", word.Name, word.Keyword))
+		}
+	}
+	return flowNext, nil
+}
+
+// Calls the subroutine with the arguments in #1 to #30.
+func (e *Expander) call(index int, word *oWord) error {
+	sub, ok := e.subs[word.Name]
+	if !ok {
+		return e.error(index, fmt.Errorf("Subroutine o%s is not defined", word.Name))
+	}
+	if len(e.scopes) > 100 {
+		return e.error(index, errors.New("Subroutine calls nested too deep"))
+	}
+	endsub := e.find(sub+1, word.Name, "endsub")
+	if endsub < 0 {
+		return e.error(sub, errors.New("sub without endsub"))
+	}
+	scope := make(map[string]float64)
+	for i, arg := range word.Args {
+		scope[strconv.Itoa(i+1)] = arg
+	}
+	e.scopes = append(e.scopes, scope)
+	delete(e.global, "<_value>")
+	_, err := e.run(sub+1, endsub+1)
+	e.scopes = e.scopes[:len(e.scopes)-1]
+	return err
+}
+
+// Runs the branch of the if whose condition is true.
+func (e *Expander) branch(index int, endif int, word *oWord) (flow, error) {
+	condition := word.Args
+	for {
+		next := e.find(index+1, word.Name, "elseif", "else", "endif")
+		if next > endif || next < 0 {
+			next = endif
+		}
+		if len(condition) == 0 || condition[0] != 0 {
+			return e.run(index+1, next)
+		}
+		if next == endif {
+			return flowNext, nil
+		}
+		index = next
+		other, err := e.parseOWord(e.lines[next].Text, true)
+		if err != nil {
+			return flowNext, e.error(next, err)
+		}
+		condition = other.Args
+		if other.Keyword == "elseif" && len(condition) == 0 {
+			return flowNext, e.error(next, errors.New("elseif without a condition"))
+		}
+	}
+}
+
+// Runs the body of a while, do or repeat loop up to the closing line.
+func (e *Expander) loop(index int, closing int, word *oWord) (flow, error) {
+	for count := 0; ; count++ {
+		switch word.Keyword {
+		case "while", "repeat":
+			{
+				args := word.Args
+				if count > 0 && word.Keyword == "while" { // the repeat count is evaluated once
+					again, err := e.parseOWord(e.lines[index].Text, true)
+					if err != nil {
+						return flowNext, e.error(index, err)
+					}
+					args = again.Args
+				}
+				if len(args) == 0 {
+					return flowNext, e.error(index, fmt.Errorf("%s without a condition", word.Keyword))
+				}
+				if (word.Keyword == "while" && args[0] == 0) || (word.Keyword == "repeat" && float64(count) >= args[0]) {
+					return flowNext, nil
+				}
+			}
+		case "do":
+			{
+				if count > 0 {
+					end, err := e.parseOWord(e.lines[closing].Text, true)
+					if err != nil {
+						return flowNext, e.error(closing, err)
+					}
+					if len(end.Args) == 0 || end.Args[0] == 0 {
+						return flowNext, nil
+					}
+				}
+			}
+		}
+		if count > MaxExpandedLines || len(e.output) > MaxExpandedLines {
+			return flowNext, e.error(index, errors.New("Too many lines, the loop does not end"))
+		}
+		f, err := e.run(index+1, closing)
+		if err != nil || f == flowReturn {
+			return f, err
+		}
+		if f == flowBreak {
+			return flowNext, nil
+		}
+	}
+}
+
+// Parses the O-word at the start of the line, nil if the line has none.
+// The bracketed arguments are only evaluated if evaluate is set.
+func (e *Expander) parseOWord(text string, evaluate bool) (*oWord, error) {
+	rs := NewRunesScanner(text)
+	rs.SkipSpaces()
+	if rs.Peek() == '/' {
+		rs.index++
+		rs.SkipSpaces()
+	}
+	if unicode.ToUpper(rs.Peek()) != 'O' {
+		return nil, nil
+	}
+	word := &oWord{Column: rs.index + 1}
+	rs.index++
+	if rs.Peek() == '<' {
+		start := rs.index
+		for rs.Scan() && rs.Peek() != '>' {
+			rs.index++
+		}
+		if !rs.Scan() {
+			return nil, &ParseError{Column: word.Column, Word: text[start:], Reason: "Invalid O-word name"}
+		}
+		rs.index++
+		word.Name = strings.ToLower(strings.ReplaceAll(string(rs.runes[start:rs.index]), " ", ""))
+	} else {
+		digits := make([]rune, 0)
+		for unicode.IsDigit(rs.Peek()) {
+			digits = append(digits, rs.Rune())
+		}
+		if len(digits) == 0 {
+			return nil, &ParseError{Column: word.Column, Word: "O", Reason: "Invalid O-word name"}
+		}
+		number, _ := strconv.Atoi(string(digits))
+		word.Name = strconv.Itoa(number)
+	}
+	rs.SkipSpaces()
+	word.Keyword = strings.ToLower(rs.Letters())
+	for {
+		rs.SkipSpaces()
+		if rs.Peek() != '[' || !evaluate {
+			break
+		}
+		column := rs.index + 1
+		value, err := rs.Expression(e)
+		if err != nil {
+			return nil, &ParseError{Column: column, Word: string(rs.runes[column-1 : rs.index]), Reason: err.Error()}
+		}
+		word.Args = append(word.Args, value)
+	}
+	return word, nil
+}
+
+// Formats a value as a gcode number.
+func formatValue(value float64) string {
+	str := strconv.FormatFloat(value, 'f', 6, 64)
+	str = strings.TrimRight(strings.TrimRight(str, "0"), ".")
+	if str == "-0" {
+		return "0"
+	}
+	return str
+}
+
+// Replaces the parameters and expressions of the line with their values and applies its parameter
+// settings after the line has been read. Lines without any are kept unchanged.
+func (e *Expander) expandLine(index int) error {
+	line := e.lines[index]
+	if !strings.ContainsAny(line.Text, "#[") { // kept without the indentation of the program
+		if text := strings.TrimSpace(line.Text); len(text) > 0 {
+			e.output = append(e.output, Line{Text: text, Number: line.Number})
+		}
+		return nil
+	}
+	rs := NewRunesScanner(line.Text)
+	var sb strings.Builder
+	names := make([]string, 0)
+	values := make([]float64, 0)
+	for rs.Scan() {
+		column := rs.index + 1
+		r := rs.Peek()
+		switch r {
+		case '(':
+			{
+				sb.WriteString(string(*rs.Until(true, ')')))
+				sb.WriteRune(')')
+			}
+		case ';':
+			{
+				sb.WriteString(string(*rs.Until(false, ' ')))
+			}
+		case '#':
+			{
+				name, err := rs.Parameter(e)
+				setting := false
+				var value float64
+				if err == nil {
+					end := rs.index
+					rs.SkipSpaces()
+					setting = rs.Peek() == '='
+					if setting {
+						rs.index++
+						value, err = rs.unary(e)
+					} else {
+						rs.index = end // keep the spaces after the value
+						value, err = e.Get(name)
+					}
+				}
+				if err != nil {
+					return e.error(index, &ParseError{Column: column, Word: string(rs.runes[column-1 : rs.index]), Reason: err.Error()})
+				}
+				if setting {
+					names = append(names, name)
+					values = append(values, value)
+				} else {
+					e.writeValue(&sb, value)
+				}
+			}
+		case '[':
+			{
+				value, err := rs.Expression(e)
+				if err != nil {
+					return e.error(index, &ParseError{Column: column, Word: string(rs.runes[column-1 : rs.index]), Reason: err.Error()})
+				}
+				e.writeValue(&sb, value)
+			}
+		default:
+			sb.WriteRune(rs.Rune())
+		}
+	}
+	for i, name := range names {
+		e.set(name, values[i])
+	}
+	if text := strings.TrimSpace(sb.String()); len(text) > 0 {
+		e.output = append(e.output, Line{Text: text, Number: line.Number})
+	}
+	return nil
+}
+
+// Writes the value, a minus sign before it is combined with a negative value.
+func (e *Expander) writeValue(sb *strings.Builder, value float64) {
+	str := sb.String()
+	if value < 0 && strings.HasSuffix(str, "-") {
+		sb.Reset()
+		sb.WriteString(str[:len(str)-1])
+		value = -value
+	}
+	sb.WriteString(formatValue(value))
+}
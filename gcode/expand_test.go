@@ -0,0 +1,120 @@
+package gcode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func expand(t *testing.T, program string) ([]Line, error) {
+	lines := make([]Line, 0)
+	for i, text := range strings.Split(program, "\n") {
+		lines = append(lines, Line{Text: text, Number: i + 1})
+	}
+	return NewExpander(lines).Expand()
+}
+
+func texts(lines []Line) []string {
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		result[i] = line.Text
+	}
+	return result
+}
+
+func TestExpand(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Parameters", func(t *testing.T) {
+		got, err := expand(t, "#1=2 #<x>=[#1*3]\n#<x>=[#1*3]\nG1 X#<x> Y-#1 Z[#1-0.5] (#1 kept)\n  G0 Z5 #1=[#1+1]\nG1 X#1")
+		require.Empty(t, err)
+		assert.EqualValues([]string{"G1 X6 Y-2 Z1.5 (#1 kept)", "G0 Z5", "G1 X3"}, texts(got))
+		assert.EqualValues(3, got[0].Number)
+		assert.EqualValues(5, got[2].Number)
+
+		got, err = expand(t, "#1=1\n#1=2 G1 X#1")
+		require.Empty(t, err)
+		assert.EqualValues([]string{"G1 X1"}, texts(got), "set after the line is read")
+
+		got, err = expand(t, "#1=-2\nG1 X-#1")
+		require.Empty(t, err)
+		assert.EqualValues([]string{"G1 X2"}, texts(got))
+	})
+
+	t.Run("Subroutine", func(t *testing.T) {
+		program := `o<cut> sub
+  #<depth> = #1
+  G1 Z#<depth>
+  o<cut> return [#<depth> * 2]
+  G1 Z99
+o<cut> endsub
+#<depth> = 7
+o<cut> call [-1]
+G0 Z#<_value>
+G0 X#<depth>`
+		got, err := expand(t, program)
+		require.Empty(t, err)
+		assert.EqualValues([]string{"G1 Z-1", "G0 Z-2", "G0 X7"}, texts(got))
+		assert.EqualValues([]int{3, 9, 10}, []int{got[0].Number, got[1].Number, got[2].Number})
+	})
+
+	t.Run("Loops", func(t *testing.T) {
+		program := `#1 = 0
+o1 while [#1 LT 5]
+  #1 = [#1 + 1]
+  o2 if [#1 EQ 2]
+    o1 continue
+  o2 elseif [#1 EQ 4]
+    o1 break
+  o2 else
+    G1 X#1
+  o2 endif
+o1 endwhile
+o3 repeat [2]
+  G0 Z1
+o3 endrepeat
+o4 do
+  G0 Z2
+o4 while [0]`
+		got, err := expand(t, program)
+		require.Empty(t, err)
+		assert.EqualValues([]string{"G1 X1", "G1 X3", "G0 Z1", "G0 Z1", "G0 Z2"}, texts(got))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := map[string]struct {
+			program string
+			line    int
+		}{
+			"endless":   {program: "G0 Z1\no1 while [1]\no1 endwhile", line: 2},
+			"undefined": {program: "G0 Z1\nG1 X#<x>", line: 2},
+			"no endif":  {program: "o1 if [1]\nG0 Z1", line: 1},
+			"no sub":    {program: "o<x> call", line: 1},
+			"bracket":   {program: "G1 X[1+", line: 1},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := expand(t, tc.program)
+				var pe *ParseError
+				require.True(t, errors.As(err, &pe), "not a ParseError: %v", err)
+				assert.EqualValues(tc.line, pe.Line)
+			})
+		}
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		r := NewReader(strings.NewReader("%\n#1=3\no1 repeat [#1]\nG1 X#1\no1 endrepeat\nG1 X#<y>\nM30\n"))
+		r.Expand = true
+		blocks, parseErrors, err := r.ReadAll()
+		require.Empty(t, err)
+		assert.EqualValues(4, len(blocks))
+		assert.EqualValues(4, blocks[1].Line)
+		assert.EqualValues(3, blocks[3].X.Value)
+		require.EqualValues(t, 1, len(parseErrors))
+		assert.EqualValues(6, parseErrors[0].Line)
+	})
+}
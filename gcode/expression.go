@@ -0,0 +1,317 @@
+// expression
+package gcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Parameters holds the numbered and named parameters of a LinuxCNC program.
+// Numbered parameters are keyed by their number, named ones by "<name>" in lower case.
+type Parameters interface {
+	Get(name string) (float64, error)
+	Exists(name string) bool
+}
+
+// Binary operators by precedence, lowest first.
+var binaryOperators = [][]string{
+	{"AND", "OR", "XOR"},
+	{"EQ", "NE", "GT", "GE", "LT", "LE"},
+	{"+", "-"},
+	{"*", "/", "MOD"},
+	{"**"},
+}
+
+// Returns the next rune without moving on, 0 at the end of the line.
+func (rs *RunesScanner) Peek() rune {
+	if !rs.Scan() {
+		return 0
+	}
+	return rs.runes[rs.index]
+}
+
+// Moves past spaces and tabs.
+func (rs *RunesScanner) SkipSpaces() {
+	for rs.Peek() == ' ' || rs.Peek() == '\t' {
+		rs.index++
+	}
+}
+
+// Returns the letters at the current position in upper case.
+func (rs *RunesScanner) Letters() string {
+	start := rs.index
+	for unicode.IsLetter(rs.Peek()) {
+		rs.index++
+	}
+	return strings.ToUpper(string(rs.runes[start:rs.index]))
+}
+
+// Evaluates a bracketed expression starting at '['.
+func (rs *RunesScanner) Expression(params Parameters) (float64, error) {
+	rs.SkipSpaces()
+	if rs.Peek() != '[' {
+		return 0, errors.New("Expected [")
+	}
+	rs.index++
+	value, err := rs.binary(params, 0)
+	if err != nil {
+		return 0, err
+	}
+	rs.SkipSpaces()
+	if rs.Peek() != ']' {
+		return 0, errors.New("Expected ]")
+	}
+	rs.index++
+	return value, nil
+}
+
+// Evaluates operators of the precedence level and above, left to right.
+func (rs *RunesScanner) binary(params Parameters, level int) (float64, error) {
+	if level == len(binaryOperators) {
+		return rs.unary(params)
+	}
+	left, err := rs.binary(params, level+1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		rs.SkipSpaces()
+		op := rs.operator(binaryOperators[level])
+		if op == "" {
+			return left, nil
+		}
+		right, err := rs.binary(params, level+1)
+		if err != nil {
+			return 0, err
+		}
+		left, err = apply(op, left, right)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Returns and moves past the operator at the current position if it is one of ops.
+func (rs *RunesScanner) operator(ops []string) string {
+	for _, op := range ops {
+		end := rs.index + len(op)
+		if end > len(rs.runes) || strings.ToUpper(string(rs.runes[rs.index:end])) != op {
+			continue
+		}
+		if op == "*" && end < len(rs.runes) && rs.runes[end] == '*' { // not a power
+			continue
+		}
+		rs.index = end
+		return op
+	}
+	return ""
+}
+
+func apply(op string, left float64, right float64) (float64, error) {
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	switch op {
+	case "AND":
+		return boolean(left != 0 && right != 0), nil
+	case "OR":
+		return boolean(left != 0 || right != 0), nil
+	case "XOR":
+		return boolean((left != 0) != (right != 0)), nil
+	case "EQ":
+		return boolean(left == right), nil
+	case "NE":
+		return boolean(left != right), nil
+	case "GT":
+		return boolean(left > right), nil
+	case "GE":
+		return boolean(left >= right), nil
+	case "LT":
+		return boolean(left < right), nil
+	case "LE":
+		return boolean(left <= right), nil
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, errors.New("Division by zero")
+		}
+		return left / right, nil
+	case "MOD":
+		if right == 0 {
+			return 0, errors.New("Division by zero")
+		}
+		m := math.Mod(left, right)
+		if m < 0 { // the result has the sign of the divisor
+			m += math.Abs(right)
+		}
+		return m, nil
+	case "**":
+		return math.Pow(left, right), nil
+	}
+	return 0, errors.New("Unknown operator " + op)
+}
+
+// Evaluates a value with optional signs.
+func (rs *RunesScanner) unary(params Parameters) (float64, error) {
+	rs.SkipSpaces()
+	switch rs.Peek() {
+	case '-':
+		rs.index++
+		value, err := rs.unary(params)
+		return -value, err
+	case '+':
+		rs.index++
+		return rs.unary(params)
+	}
+	return rs.Value(params)
+}
+
+// Evaluates a number, parameter, bracketed expression or function.
+func (rs *RunesScanner) Value(params Parameters) (float64, error) {
+	rs.SkipSpaces()
+	r := rs.Peek()
+	switch {
+	case r == '[':
+		return rs.Expression(params)
+	case r == '#':
+		name, err := rs.Parameter(params)
+		if err != nil {
+			return 0, err
+		}
+		return params.Get(name)
+	case r == '.' || unicode.IsDigit(r):
+		start := rs.index
+		for rs.Peek() == '.' || unicode.IsDigit(rs.Peek()) {
+			rs.index++
+		}
+		str := string(rs.runes[start:rs.index])
+		value, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return 0, errors.New("Invalid number " + str)
+		}
+		return value, nil
+	case unicode.IsLetter(r):
+		return rs.function(params)
+	}
+	return 0, fmt.Errorf("Unexpected character %q in expression", r)
+}
+
+// Parses a parameter reference starting at '#' and returns its name, #<name>, #1, #[expr] and ##1 are accepted.
+func (rs *RunesScanner) Parameter(params Parameters) (string, error) {
+	if rs.Peek() != '#' {
+		return "", errors.New("Expected #")
+	}
+	rs.index++
+	rs.SkipSpaces()
+	if rs.Peek() == '<' {
+		rs.index++
+		name := make([]rune, 0)
+		for rs.Scan() && rs.Peek() != '>' {
+			r := rs.Rune()
+			if r != ' ' && r != '\t' { // spaces in names are ignored
+				name = append(name, unicode.ToLower(r))
+			}
+		}
+		if !rs.Scan() || len(name) == 0 {
+			return "", errors.New("Invalid parameter name")
+		}
+		rs.index++
+		return "<" + string(name) + ">", nil
+	}
+	number, err := rs.Value(params) // #1, #[expr] and ##1
+	if err != nil {
+		return "", err
+	}
+	if number < 1 || number != math.Trunc(number) {
+		return "", fmt.Errorf("Invalid parameter number %g", number)
+	}
+	return strconv.Itoa(int(number)), nil
+}
+
+// Evaluates a function, the argument is a bracketed expression.
+func (rs *RunesScanner) function(params Parameters) (float64, error) {
+	name := rs.Letters()
+	if name == "EXISTS" {
+		rs.SkipSpaces()
+		if rs.Peek() != '[' {
+			return 0, errors.New("Expected [")
+		}
+		rs.index++
+		rs.SkipSpaces()
+		parameter, err := rs.Parameter(params)
+		if err != nil {
+			return 0, err
+		}
+		rs.SkipSpaces()
+		if rs.Peek() != ']' {
+			return 0, errors.New("Expected ]")
+		}
+		rs.index++
+		if params.Exists(parameter) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	arg, err := rs.Expression(params)
+	if err != nil {
+		return 0, err
+	}
+	degrees := math.Pi / 180
+	switch name {
+	case "ABS":
+		return math.Abs(arg), nil
+	case "ACOS":
+		return math.Acos(arg) / degrees, nil
+	case "ASIN":
+		return math.Asin(arg) / degrees, nil
+	case "ATAN":
+		rs.SkipSpaces()
+		if rs.Peek() != '/' { // ATAN[y]/[x]
+			return 0, errors.New("Expected / in ATAN")
+		}
+		rs.index++
+		x, err := rs.Expression(params)
+		if err != nil {
+			return 0, err
+		}
+		return math.Atan2(arg, x) / degrees, nil
+	case "COS":
+		return math.Cos(arg * degrees), nil
+	case "EXP":
+		return math.Exp(arg), nil
+	case "FIX":
+		return math.Floor(arg), nil
+	case "FUP":
+		return math.Ceil(arg), nil
+	case "LN":
+		if arg <= 0 {
+			return 0, errors.New("LN of a value that is not positive")
+		}
+		return math.Log(arg), nil
+	case "ROUND":
+		return math.Round(arg), nil
+	case "SIN":
+		return math.Sin(arg * degrees), nil
+	case "SQRT":
+		if arg < 0 {
+			return 0, errors.New("SQRT of a negative value")
+		}
+		return math.Sqrt(arg), nil
+	case "TAN":
+		return math.Tan(arg * degrees), nil
+	}
+	return 0, errors.New("Unknown function " + name)
+}
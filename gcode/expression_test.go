@@ -0,0 +1,64 @@
+package gcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpression(t *testing.T) {
+	assert := assert.New(t)
+	params := NewExpander(nil)
+	params.set("1", 3)
+	params.set("<width>", 10)
+	params.set("5220", 2)
+	params.set("3", 1.5)
+
+	tests := map[string]struct {
+		expr  string
+		value float64
+	}{
+		"number":     {expr: "[1.5]", value: 1.5},
+		"precedence": {expr: "[1 + 2 * 3 - 4 / 2]", value: 5},
+		"power":      {expr: "[2 ** 3 * 2]", value: 16},
+		"brackets":   {expr: "[[1 + 2] * 3]", value: 9},
+		"unary":      {expr: "[-#1 + -[2]]", value: -5},
+		"mod":        {expr: "[-7 MOD 3]", value: 2},
+		"compare":    {expr: "[#1 GT 2 AND #<width> LE 10]", value: 1},
+		"xor":        {expr: "[1 XOR 1]", value: 0},
+		"named":      {expr: "[#< Width > / 4]", value: 2.5},
+		"indirect":   {expr: "[##1 + #[2 + 1]]", value: 3},
+		"numbered":   {expr: "[#5220 + #99]", value: 2},
+		"functions":  {expr: "[SIN[30] + COS[60] + SQRT[16] + ABS[-2]]", value: 7},
+		"atan":       {expr: "[ATAN[1]/[1]]", value: 45},
+		"round":      {expr: "[ROUND[2.5] + FIX[-1.5] + FUP[1.2]]", value: 3},
+		"exists":     {expr: "[EXISTS[#<width>] + EXISTS[#<depth>]]", value: 1},
+		"lower case": {expr: "[sin[90] eq 1]", value: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rs := NewRunesScanner(tc.expr)
+			value, err := rs.Expression(params)
+			require.Emptyf(t, err, "failed '%s': %s", tc.expr, err)
+			assert.InDelta(tc.value, value, 1e-9)
+			assert.False(rs.Scan(), "all of the expression used")
+		})
+	}
+
+	errorTests := map[string]string{
+		"unclosed":  "[1 + 2",
+		"undefined": "[#<depth>]",
+		"divide":    "[1 / 0]",
+		"function":  "[FOO[1]]",
+		"operator":  "[1 ? 2]",
+	}
+	for name, expr := range errorTests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewRunesScanner(expr).Expression(params)
+			assert.NotEmpty(err)
+		})
+	}
+}
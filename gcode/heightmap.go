@@ -0,0 +1,124 @@
+// heightmap
+package gcode
+
+import (
+	"math"
+)
+
+// Heightmap is the Z of a surface over a grid of square cells in the XY plane.
+type Heightmap struct {
+	X0   float64 // of the center of the first cell
+	Y0   float64
+	Cell float64
+	Cols int
+	Rows int
+	Z    []float64 // by row
+	Top  float64   // of the surface outside the map
+}
+
+// Returns a map covering the ranges with a margin around them, every cell at top.
+func NewHeightmap(x MinMax, y MinMax, margin float64, cell float64, top float64) *Heightmap {
+	h := &Heightmap{X0: x.Min - margin, Y0: y.Min - margin, Cell: cell, Top: top}
+	h.Cols = int(math.Ceil((x.Max-x.Min+2*margin)/cell)) + 1
+	h.Rows = int(math.Ceil((y.Max-y.Min+2*margin)/cell)) + 1
+	h.Z = make([]float64, h.Cols*h.Rows)
+	for i := range h.Z {
+		h.Z[i] = top
+	}
+	return h
+}
+
+// Returns the column and row of the cell nearest the point.
+func (h *Heightmap) cell(x float64, y float64) (int, int) {
+	return int(math.Round((x - h.X0) / h.Cell)), int(math.Round((y - h.Y0) / h.Cell))
+}
+
+// Returns the Z of the cell, Top outside the map.
+func (h *Heightmap) At(col int, row int) float64 {
+	if col < 0 || row < 0 || col >= h.Cols || row >= h.Rows {
+		return h.Top
+	}
+	return h.Z[row*h.Cols+col]
+}
+
+// Kernel is a profile sampled at the cells of a map around its axis.
+type Kernel []kernelCell
+
+type kernelCell struct {
+	col    int
+	row    int
+	height float64
+}
+
+// Returns the profile sampled at the centers of cells of the size.
+func NewKernel(profile Profile, cell float64) Kernel {
+	n := int(math.Ceil(profile.Radius() / cell))
+	k := make(Kernel, 0, (2*n+1)*(2*n+1))
+	for row := -n; row <= n; row++ {
+		for col := -n; col <= n; col++ {
+			r := math.Hypot(float64(col), float64(row)) * cell
+			if r <= profile.Radius() {
+				k = append(k, kernelCell{col: col, row: row, height: profile.Height(r)})
+			}
+		}
+	}
+	return k
+}
+
+// Lowers the surface to the profile of the kernel with its tip at the point.
+func (h *Heightmap) Cut(k Kernel, p Point) {
+	col, row := h.cell(p.X, p.Y)
+	for _, kc := range k {
+		c, r := col+kc.col, row+kc.row
+		if c < 0 || r < 0 || c >= h.Cols || r >= h.Rows {
+			continue
+		}
+		i := r*h.Cols + c
+		h.Z[i] = math.Min(h.Z[i], p.Z+kc.height)
+	}
+}
+
+// Lowers the surface along the straight line between the points.
+func (h *Heightmap) CutLine(k Kernel, from Point, to Point) {
+	steps := int(math.Ceil(math.Hypot(to.X-from.X, to.Y-from.Y)/(h.Cell/2))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		h.Cut(k, Point{X: from.X + (to.X-from.X)*t, Y: from.Y + (to.Y-from.Y)*t, Z: from.Z + (to.Z-from.Z)*t})
+	}
+}
+
+// Lowers the surface along a resolved move, the shift is added to its positions.
+func (h *Heightmap) CutMove(k Kernel, block *Block, shift Point) {
+	if !block.IsMove() || block.State.Motion == Rapid || block.IsHome() {
+		return // rapids do not cut
+	}
+	if !block.State.KnownX || !block.State.KnownY || !block.State.KnownZ {
+		return
+	}
+	move := func(p Point) Point {
+		return Point{X: p.X + shift.X, Y: p.Y + shift.Y, Z: p.Z + shift.Z}
+	}
+	if block.IsArc() {
+		if arc, err := block.Arc(block.Start); err == nil {
+			steps := int(math.Ceil(arc.Length()/(h.Cell/2))) + 1
+			from := arc.Start
+			for i := 1; i <= steps; i++ {
+				to := arc.PointAt(float64(i) / float64(steps))
+				h.CutLine(k, move(from), move(to))
+				from = to
+			}
+			return
+		}
+	}
+	h.CutLine(k, move(block.Start), move(block.State.Position))
+}
+
+// Returns the lowest Z of the tip of the kernel at X/Y that is not below the surface.
+func (h *Heightmap) Drop(k Kernel, x float64, y float64) float64 {
+	col, row := h.cell(x, y)
+	z := math.Inf(-1)
+	for _, kc := range k {
+		z = math.Max(z, h.At(col+kc.col, row+kc.row)-kc.height)
+	}
+	return z
+}
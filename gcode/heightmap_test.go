@@ -0,0 +1,177 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeightmap(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MinMax{Min: 0, Max: 10}
+	y := MinMax{Min: 0, Max: 10}
+	h := NewHeightmap(x, y, 2, 0.1, 0)
+	assert.EqualValues(141, h.Cols)
+	assert.EqualValues(0, h.At(-1, 0), "outside")
+
+	ball := Tool{Shape: BallEnd, Diameter: 2}
+	k := NewKernel(&ball, h.Cell)
+	h.CutLine(k, Point{X: 2, Y: 5, Z: -1}, Point{X: 8, Y: 5, Z: -1})
+	col, row := h.cell(5, 5)
+	assert.InDelta(-1, h.At(col, row), 1e-9, "bottom of the groove")
+	col, row = h.cell(5, 5.5)
+	assert.InDelta(-1+ball.Height(0.5), h.At(col, row), 1e-9, "side of the groove")
+	col, row = h.cell(5, 7)
+	assert.EqualValues(0, h.At(col, row), "not cut")
+
+	t.Run("Drop", func(t *testing.T) {
+		assert.InDelta(-1, h.Drop(k, 5, 5), 1e-9, "the same tool fits the groove")
+		flat := Tool{Shape: FlatEnd, Diameter: 1}
+		assert.InDelta(-1+ball.Height(0.5), h.Drop(NewKernel(&flat, h.Cell), 5, 5), 1e-9, "a flat tool rests on the sides")
+		assert.InDelta(0, h.Drop(k, 5, 7), 1e-9, "on the top")
+	})
+
+	t.Run("Moves", func(t *testing.T) {
+		h := NewHeightmap(x, y, 2, 0.1, 0)
+		blocks := Blocks{}
+		for _, line := range []string{"G0 X0 Y0 Z-3", "G1 X10", "G3 X10 Y4 J2", "G0 Y10 Z-5"} {
+			b, err := ParseLine(line)
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+		blocks.Resolve()
+		for _, block := range blocks {
+			h.CutMove(k, block, Point{})
+		}
+		col, row := h.cell(5, 0)
+		assert.InDelta(-3, h.At(col, row), 1e-9, "along the line")
+		col, row = h.cell(12, 2)
+		assert.InDelta(-3, h.At(col, row), 0.01, "along the arc")
+		col, row = h.cell(10, 8)
+		assert.EqualValues(0, h.At(col, row), "rapids do not cut")
+	})
+}
+
+func TestToStepZSurface(t *testing.T) {
+	assert := assert.New(t)
+
+	info := Info{Increment: -3, MinCut: 0.5}
+	info.Init()
+	info.X.Update(-5)
+	info.X.Update(5)
+	info.Y.Update(-5)
+	info.Y.Update(5)
+	require.NoError(t, info.NewSurface(Tool{Shape: FlatEnd, Diameter: 2}, 0.1))
+	for i := range info.Surface.Z { // a vertical wall at X0 down to a floor at Z-10
+		col := i % info.Surface.Cols
+		if info.Surface.X0+float64(col)*info.Surface.Cell > info.Surface.Cell/2 {
+			info.Surface.Z[i] = -10
+		}
+	}
+
+	tests := map[string]struct {
+		line string
+		z    float64
+	}{
+		"Far from the wall": {line: "G1 X4 Y0 Z-8", z: -2.5},
+		"Beside the wall":   {line: "G1 X1.2 Y0 Z-8", z: math.Sqrt(0.25 - 0.04)},
+		"No Z":              {line: "G1 X1.2 Y0", z: math.Sqrt(0.25 - 0.04)},
+		"Under the tool":    {line: "G1 X0.8 Y0 Z-8", z: 0.5},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			blocks := Blocks{}
+			for _, line := range []string{"G0 X4 Y0 Z-8", tc.line} {
+				b, err := ParseLine(line)
+				require.NoError(t, err)
+				blocks = append(blocks, b)
+			}
+			blocks.Resolve()
+			b := blocks[1].Copy()
+			b.ToStepZ(&info, 1)
+			require.NotNil(t, b.Z)
+			assert.True(b.IsClamped)
+			assert.InDelta(tc.z, b.Z.Value, 1e-6)
+		})
+	}
+}
+
+func TestSplitAlongSurface(t *testing.T) {
+	assert := assert.New(t)
+
+	info := Info{Increment: -3, MinCut: 0.5}
+	info.Init()
+	info.X.Update(-5)
+	info.X.Update(5)
+	info.Y.Update(-5)
+	info.Y.Update(5)
+	require.NoError(t, info.NewSurface(Tool{Shape: FlatEnd, Diameter: 2}, 0.1))
+	for i := range info.Surface.Z { // a post at the origin standing on a floor at Z-10
+		x := info.Surface.X0 + float64(i%info.Surface.Cols)*info.Surface.Cell
+		y := info.Surface.Y0 + float64(i/info.Surface.Cols)*info.Surface.Cell
+		if math.Abs(x) > 0.5 || math.Abs(y) > 0.5 {
+			info.Surface.Z[i] = -10
+		}
+	}
+
+	info.Start = NewState()
+
+	tests := map[string]struct {
+		start string
+		line  string
+		split bool
+	}{
+		"Beside the post":   {start: "G0 X-4 Y1.5 Z-8", line: "G1 X4 Y1.5 Z-8", split: true},
+		"Away":              {start: "G0 X-4 Y-4 Z-8", line: "G1 X4 Y-4 Z-8", split: false},
+		"Rapid":             {start: "G0 X-4 Y1.5 Z-8", line: "G0 X4 Y1.5 Z-8", split: false},
+		"Arc over the post": {start: "G0 X-4 Y1.5 Z-8", line: "G3 X4 Y1.5 Z-8 I4 J8.5", split: true},
+		"Arc away":          {start: "G0 X-4 Y-4 Z-8", line: "G3 X4 Y-4 Z-8 I4 J8.5", split: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			blocks := Blocks{}
+			for _, line := range []string{tc.start, tc.line} {
+				b, err := ParseLine(line)
+				require.NoError(t, err)
+				blocks = append(blocks, b)
+			}
+			blocks.Resolve()
+			pieces := blocks.SplitAlongSurface(&info)[1:]
+			if !tc.split {
+				require.Len(t, pieces, 1)
+				assert.Same(blocks[1], pieces[0])
+				return
+			}
+			require.Greater(t, len(pieces), 1)
+			z := -2.5 // the start is clamped to the pass
+			for _, piece := range pieces {
+				assert.InDelta(-8, piece.Z.Value, 1e-9, "Z of the data")
+				assert.Equal(blocks[1].IsArc(), piece.IsArc())
+				c := piece.Copy()
+				c.ToStepZ(&info, 1)
+				arc, err := c.Arc(c.Start)
+				if !piece.IsArc() {
+					arc = Arc{Start: piece.Start, End: piece.State.Position} // only the ends are used
+				} else {
+					require.NoError(t, err)
+				}
+				n := int(math.Ceil(math.Max(arc.Length(), math.Abs(arc.End.X-arc.Start.X)) / (info.Surface.Cell / 2)))
+				for j := 0; j <= n; j++ { // the move between the clamped ends, at the samples
+					s := float64(j) / float64(n)
+					p := Point{X: arc.Start.X + (arc.End.X-arc.Start.X)*s, Y: arc.Start.Y + (arc.End.Y-arc.Start.Y)*s}
+					if piece.IsArc() {
+						p = arc.PointAt(s)
+					}
+					assert.GreaterOrEqual(z+(c.Z.Value-z)*s, info.Clearance(p.X, p.Y)-info.MinCut/10-1e-9, "clear at X%.3f Y%.3f", p.X, p.Y)
+				}
+				z = c.Z.Value
+			}
+			assert.InDelta(4, pieces[len(pieces)-1].State.Position.X, 1e-9)
+		})
+	}
+}
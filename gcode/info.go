@@ -1,22 +1,25 @@
 package gcode
 
 import (
+	"errors"
+	"fmt"
 	"math"
+	"sort"
 
 	"github.com/adrianre12/logl"
 )
 
 type MinMax struct {
-	Min float32
-	Max float32
+	Min float64
+	Max float64
 }
 
 func (mm *MinMax) Init() {
-	mm.Min = math.MaxFloat32
-	mm.Max = -math.MaxFloat32
+	mm.Min = math.MaxFloat64
+	mm.Max = -math.MaxFloat64
 }
 
-func (mm *MinMax) Update(value float32) {
+func (mm *MinMax) Update(value float64) {
 	if value > mm.Max {
 		mm.Max = value
 	}
@@ -25,41 +28,438 @@ func (mm *MinMax) Update(value float32) {
 	}
 }
 
+// True if the range has been updated.
+func (mm *MinMax) IsSet() bool {
+	return mm.Min <= mm.Max
+}
+
 type Info struct {
-	Setup      Blocks
-	Data       Blocks
-	Finish     Blocks
-	X          MinMax
-	Y          MinMax
-	Z          MinMax
-	Increment  float32
-	MinCut     float32
-	SkipHeight float32
-	FeedRate   float32
-	Pretty     bool
+	Setup         Blocks
+	Data          Blocks
+	Finish        Blocks
+	X             MinMax
+	Y             MinMax
+	Z             MinMax
+	A             MinMax
+	B             MinMax
+	C             MinMax
+	U             MinMax
+	V             MinMax
+	W             MinMax
+	Increment     float64
+	Depths        []float64 // depth below Top of each pass, passes step by Increment when empty or after the last
+	MinCut        float64
+	SkipHeight    float64 // above Top
+	Top           float64 // Z of the top of the stock, the stock radius for jobs wrapped around a rotary axis
+	FeedRate      float64
+	Tolerance     float64    // positions closer than this are the same
+	Surface       *Heightmap // left by the data, with the tool roughing points are clamped above it, nil to clamp only Z
+	Stock         *Heightmap // left by the roughing, moves cutting no more than RestThreshold of it are skipped, nil to cut all
+	RestThreshold float64
+	Entry         Entry   // from the skip height into the stock
+	EntryAngle    float64 // steepest descent in degrees of ramps and helices
+	HelixRadius   float64
+	EntryFeed     float64 // 0 for the feed of the cuts
+	Pretty        bool
+	SourceLines   bool // output the source line number of each block
+	Units         Units
+	Tool          int
+	Start         State // state before the first data block
+	End           State // state after the last data block
+	wcsWarned     bool
+	cutter        Kernel           // the tool, cutting the surface
+	clearance     Kernel           // the tool enlarged by MinCut
+	scans         map[int]*scanBin // XY feed moves by their direction to the nearest degree
+}
+
+// Linear feed moves in about the same XY direction.
+type scanBin struct {
+	length float64
+	sum    Point // of the moves turned to point the same way
 }
 
 func (i *Info) Init() {
 	i.X.Init()
 	i.Y.Init()
 	i.Z.Init()
+	for _, axis := range AuxiliaryAxes {
+		i.Auxiliary(axis).Init()
+	}
+}
+
+// Returns the range of the rotary or auxiliary linear axis.
+func (i *Info) Auxiliary(axis string) *MinMax {
+	switch axis {
+	case "A":
+		return &i.A
+	case "B":
+		return &i.B
+	case "C":
+		return &i.C
+	case "U":
+		return &i.U
+	case "V":
+		return &i.V
+	}
+	return &i.W
+}
+
+// True if the data moves a rotary axis.
+func (i *Info) IsRotary() bool {
+	return i.A.IsSet() || i.B.IsSet() || i.C.IsSet()
 }
 
 func (i *Info) Passes() int {
-	if i.Z.Min > 0 {
-		logl.Fatal("MinZ > 0")
+	if i.Z.Min > i.Top {
+		logl.Fatal("MinZ > Top")
+	}
+	return i.PassOf(i.Z.Min - i.Top)
+}
+
+// Returns the depth below Top of the bottom of the pass, 0 before the first pass.
+func (i *Info) Depth(pass int) float64 {
+	if pass <= 0 {
+		return 0
+	}
+	n := len(i.Depths)
+	if pass <= n {
+		return i.Depths[pass-1]
+	}
+	if n == 0 {
+		return i.Increment * float64(pass)
+	}
+	return i.Depths[n-1] + i.Increment*float64(pass-n)
+}
+
+// Sets Depths to the passes of Increment spread evenly down to the bottom of the data, so that every pass
+// steps by the same depth. If capped, passes are added so that the finish pass, which also removes MinCut,
+// steps at most Increment.
+func (i *Info) EvenDepths(capped bool) error {
+	if i.Increment >= 0 {
+		return fmt.Errorf("Increment %g must be negative", i.Increment)
+	}
+	bottom := i.Z.Min - i.Top
+	i.Depths = nil
+	if bottom >= 0 {
+		return nil
+	}
+	passes := int(math.Ceil(bottom / i.Increment))
+	if capped && i.MinCut > 0 {
+		if i.Increment+i.MinCut >= 0 {
+			return fmt.Errorf("Increment %g must be deeper than the minimum cut %g", i.Increment, i.MinCut)
+		}
+		if n := int(math.Ceil(bottom / (i.Increment + i.MinCut))); n > passes {
+			passes = n
+		}
+	}
+	i.Depths = make([]float64, passes)
+	for k := 1; k < passes; k++ {
+		i.Depths[k-1] = bottom * float64(k) / float64(passes)
+	}
+	i.Depths[passes-1] = bottom // exactly, so that it is the last pass
+	return nil
+}
+
+// Returns the depth below Top cut by the pass, the last pass reaches the bottom of the data.
+func (i *Info) PassDepth(pass int) float64 {
+	return math.Max(i.Depth(pass), i.Z.Min-i.Top)
+}
+
+// Returns the first pass that reaches the depth below Top.
+func (i *Info) PassOf(depth float64) int {
+	n := len(i.Depths)
+	if n == 0 {
+		return int(math.Ceil(depth / i.Increment))
+	}
+	pass := sort.Search(n, func(k int) bool { return i.Depths[k] <= depth })
+	if pass < n {
+		return pass + 1
+	}
+	return n + int(math.Ceil((depth-i.Depths[n-1])/i.Increment))
+}
+
+// Sets Depths to the depths followed, down to the bottom of the data, by steps starting at Increment
+// and multiplied by ratio each pass. A ratio of 1 keeps the steps uniform, below 1 they decrease
+// but are never less than MinCut. The depths must be negative and decreasing.
+func (i *Info) ScheduleDepths(depths []float64, ratio float64) error {
+	if ratio <= 0 || ratio > 1 {
+		return fmt.Errorf("Depth ratio %g must be more than 0 and at most 1", ratio)
+	}
+	if i.Increment >= 0 {
+		return fmt.Errorf("Increment %g must be negative", i.Increment)
+	}
+	if ratio < 1 && i.MinCut <= 0 {
+		return errors.New("Decreasing steps need a positive minimum cut")
+	}
+	previous := 0.0
+	for _, depth := range depths {
+		if depth >= previous {
+			return fmt.Errorf("Depth %g is not below the previous %g", depth, previous)
+		}
+		previous = depth
+	}
+	i.Depths = append([]float64{}, depths...)
+	if ratio == 1 {
+		return nil // passes after the depths step by Increment
+	}
+	bottom := i.Z.Min - i.Top
+	step := i.Increment
+	for previous > bottom {
+		previous += step
+		i.Depths = append(i.Depths, previous)
+		step = math.Min(step*ratio, -i.MinCut)
+	}
+	return nil
+}
+
+// Default number of cells of the surface map across the tool.
+const SurfaceCells = 20
+
+// Starts a map of the surface left by the data cut with the tool, its cells are the size of cell or
+// the tool diameter divided by SurfaceCells if cell is 0. The data is added by CutSurface.
+// The ranges and MinCut must be set.
+func (i *Info) NewSurface(tool Tool, cell float64) error {
+	if err := tool.Validate(); err != nil {
+		return err
+	}
+	if cell <= 0 {
+		cell = tool.Diameter / SurfaceCells
+	}
+	i.cutter = NewKernel(&tool, cell)
+	i.clearance = NewKernel(tool.Grown(i.MinCut), cell)
+	i.Surface = NewHeightmap(i.X, i.Y, tool.Radius()+math.Max(i.MinCut, 0)+cell, cell, i.Top)
+	return nil
+}
+
+// Cuts the surface with the tool along a resolved data block.
+func (i *Info) CutSurface(block *Block) {
+	if block.State.WCS != i.Start.WCS {
+		return
+	}
+	i.Surface.CutMove(i.cutter, block, i.Shift(&block.State))
+}
+
+// Returns the lowest Z of the tip of the tool at X/Y, in the frame of the start of the data, that leaves
+// MinCut of the surface normal to it.
+func (i *Info) Clearance(x float64, y float64) float64 {
+	return i.Surface.Drop(i.clearance, x, y)
+}
+
+// Returns the blocks with each feed move split where the clearance, sampled every half cell along it,
+// rises more than a tenth of MinCut above the line between the ends of a piece, so that clamping the ends of
+// the pieces keeps the whole move clear. Arcs are split into arcs, those not in the XY plane are left as they are.
+// Without a surface the blocks are returned as they are.
+// The blocks must be resolved, blocks that are not split are not copied.
+func (bs Blocks) SplitAlongSurface(info *Info) Blocks {
+	if info.Surface == nil {
+		return bs
+	}
+	result := make(Blocks, 0, len(bs))
+	for _, block := range bs {
+		if block.State.Motion == Rapid || !block.IsMove() || block.IsAuxiliaryMove() || block.State.InverseTime ||
+			block.State.WCS != info.Start.WCS || !block.State.KnownX || !block.State.KnownY || !block.State.KnownZ {
+			result = append(result, block)
+			continue
+		}
+		result = append(result, block.splitAlong(info)...)
 	}
-	return int(math.Ceil(float64(i.Z.Min / i.Increment)))
+	return result
+}
+
+// Returns the pieces of the straight or arc move of the resolved block, the block itself if it is not split.
+func (b *Block) splitAlong(info *Info) Blocks {
+	from, to := b.Start, b.State.Position
+	shift := info.Shift(&b.State)
+	length := math.Hypot(to.X-from.X, to.Y-from.Y)
+	at := func(t float64) Point {
+		return Point{X: from.X + (to.X-from.X)*t, Y: from.Y + (to.Y-from.Y)*t, Z: from.Z + (to.Z-from.Z)*t}
+	}
+	var arc *Arc
+	if b.IsArc() {
+		a, err := b.Arc(from)
+		if err != nil || a.Plane != PlaneXY {
+			return Blocks{b}
+		}
+		arc = &a
+		length = arc.Length()
+		at = arc.PointAt
+	}
+	steps := int(math.Ceil(length / (info.Surface.Cell / 2)))
+	if steps < 2 {
+		return Blocks{b}
+	}
+	needed := make([]float64, steps+1) // lowest Z of the tip in any pass, in the frame of the block
+	for j := range needed {
+		p := at(float64(j) / float64(steps))
+		needed[j] = math.Max(info.Clearance(p.X+shift.X, p.Y+shift.Y)-shift.Z, p.Z+info.MinCut)
+	}
+	var ends []int // of the pieces
+	var split func(a int, c int)
+	split = func(a int, c int) {
+		worst, rise := -1, info.MinCut/10
+		for j := a + 1; j < c; j++ {
+			chord := needed[a] + (needed[c]-needed[a])*float64(j-a)/float64(c-a)
+			if needed[j]-chord > rise {
+				worst, rise = j, needed[j]-chord
+			}
+		}
+		if worst < 0 {
+			ends = append(ends, c)
+			return
+		}
+		split(a, worst)
+		split(worst, c)
+	}
+	split(0, steps)
+	if len(ends) == 1 {
+		return Blocks{b}
+	}
+
+	result := make(Blocks, 0, len(ends))
+	start := from
+	for k, end := range ends {
+		p := at(float64(end) / float64(steps))
+		word := p
+		if b.State.Distance == Incremental {
+			word = Point{X: p.X - start.X, Y: p.Y - start.Y, Z: p.Z - start.Z}
+		}
+		var piece Block
+		if k == 0 { // keep the other words of the block on the first piece
+			piece = b.Copy()
+			piece.RemoveArc()
+		} else {
+			piece.Init()
+		}
+		piece.Start = start
+		piece.State = b.State
+		piece.BlockDelete = b.BlockDelete
+		piece.State.Position = p
+		piece.SetG(b.State.Motion.Code())
+		piece.SetX(word.X)
+		piece.SetY(word.Y)
+		if b.Z != nil {
+			piece.SetZ(word.Z)
+		}
+		if arc != nil {
+			center := arc.Center
+			if !b.State.ArcIJK {
+				center = Point{X: center.X - start.X, Y: center.Y - start.Y}
+			}
+			piece.SetI(center.X)
+			piece.SetJ(center.Y)
+		}
+		result = append(result, &piece)
+		start = p
+	}
+	return result
+}
+
+// Starts the stock at Top, on the grid of the surface, and cuts it with the tool along the roughing blocks.
+// The surface must have been mapped.
+func (i *Info) RoughStock(tool Tool, blocks Blocks) {
+	stock := *i.Surface
+	stock.Z = make([]float64, len(i.Surface.Z))
+	for j := range stock.Z {
+		stock.Z[j] = i.Top
+	}
+	i.Stock = &stock
+	k := NewKernel(&tool, stock.Cell)
+	for _, block := range blocks {
+		i.Stock.CutMove(k, block, Point{})
+	}
+}
+
+// Returns the greatest thickness of stock above the tool on the straight move between the positions of the states.
+func (i *Info) Engagement(from *State, to *State) float64 {
+	a := i.framed(from)
+	b := i.framed(to)
+	steps := int(math.Ceil(math.Hypot(b.X-a.X, b.Y-a.Y)/(i.Stock.Cell/2))) + 1
+	thickest := math.Inf(-1)
+	for j := 0; j <= steps; j++ {
+		t := float64(j) / float64(steps)
+		z := a.Z + (b.Z-a.Z)*t
+		thickest = math.Max(thickest, i.Stock.Drop(i.cutter, a.X+(b.X-a.X)*t, a.Y+(b.Y-a.Y)*t)-z)
+	}
+	return thickest
+}
+
+// Cuts the stock with the tool along the straight move between the positions of the states.
+func (i *Info) CutStock(from *State, to *State) {
+	i.Stock.CutLine(i.cutter, i.framed(from), i.framed(to))
+}
+
+// Returns the position of the state in the frame of the start of the data.
+func (i *Info) framed(state *State) Point {
+	shift := i.Shift(state)
+	return Point{X: state.Position.X + shift.X, Y: state.Position.Y + shift.Y, Z: state.Position.Z + shift.Z}
+}
+
+// Updates the ranges with a point of the state, moved into the frame of the start of the data.
+func (i *Info) update(p Point, state *State) {
+	shift := i.Shift(state)
+	if state.KnownX {
+		i.X.Update(p.X + shift.X)
+	}
+	if state.KnownY {
+		i.Y.Update(p.Y + shift.Y)
+	}
+	if state.KnownZ {
+		i.Z.Update(p.Z + shift.Z)
+	}
+}
+
+// Returns the offset to add to a position of the state to move it into the frame of the start of the data.
+func (i *Info) Shift(state *State) Point {
+	return Point{X: state.G92.X - i.Start.G92.X, Y: state.G92.Y - i.Start.G92.Y, Z: state.G92.Z - i.Start.G92.Z}
 }
 
 func FindInfo(blocks *Blocks) Info {
+	blocks.Resolve()
+	return findInfo(*blocks, NewState())
+}
+
+// Splits the blocks into a segment for each tool, a segment starts with the block selecting the tool
+// with T after the data of the previous one, or with the block that has M06 if there is none.
+// The blocks before the first tool change are part of the first segment.
+func FindSegments(blocks *Blocks) []Info {
+	blocks.Resolve()
+	segments := make([]Info, 0)
+	start := 0
+	lastData := -1 // index of the last data block
+	hasData := false
+	state := NewState()
+	for i, block := range *blocks {
+		if block.IsToolChange() && hasData {
+			change := i
+			for j := i - 1; j > lastData; j-- {
+				if (*blocks)[j].word("T") != nil {
+					change = j
+					break
+				}
+			}
+			segments = append(segments, findInfo((*blocks)[start:change], state))
+			state = (*blocks)[change-1].State
+			start = change
+			hasData = false
+		}
+		if block.HasData {
+			hasData = true
+			lastData = i
+		}
+	}
+	segments = append(segments, findInfo((*blocks)[start:], state))
+	return segments
+}
+
+// Finds the setup, data and finish of resolved blocks, start is the state before the blocks.
+func findInfo(blocks Blocks, start State) Info {
 	//find first and last gcode blocks
 	first := math.MaxInt
 	last := 0
 	var info Info
 	info.Init()
 
-	for i, block := range *blocks {
+	for i, block := range blocks {
 		if block.HasData {
 			if i < first {
 				first = i
@@ -68,19 +468,144 @@ func FindInfo(blocks *Blocks) Info {
 				last = i
 			}
 		}
-		if block.X != nil {
-			info.X.Update((*block.X).Value)
+	}
+	logl.Debugf("first=%d last=%d", first, last)
+	if first == math.MaxInt { // no data
+		info.Setup = blocks
+		info.Data = blocks[len(blocks):]
+		info.Finish = blocks[len(blocks):]
+		info.Start = start
+		if len(blocks) > 0 {
+			info.Start = blocks[len(blocks)-1].State
 		}
-		if block.Y != nil {
-			info.Y.Update((*block.Y).Value)
+		info.End = info.Start
+		info.Units = info.Start.Units
+		info.Tool = info.Start.Tool
+		return info
+	}
+	info.Setup = blocks[:first]
+	info.Data = blocks[first : last+1]
+	info.Finish = blocks[last+1:]
+	info.Start = start
+	if first > 0 {
+		info.Start = info.Setup[len(info.Setup)-1].State
+	}
+	info.End = info.Data[len(info.Data)-1].State
+	info.Units = info.Data[0].State.Units
+	info.Tool = info.Data[0].State.Tool
+	if info.End.Units != info.Units {
+		logl.Warnf("Units change from %s to %s in the data", info.Units, info.End.Units)
+	}
+
+	for _, block := range blocks {
+		info.updateBlock(block)
+	}
+	return info
+}
+
+// Updates the ranges with the positions of a resolved block, Start must be set.
+func (i *Info) updateBlock(block *Block) {
+	if !block.IsMove() {
+		return
+	}
+	if block.State.WCS != i.Start.WCS { // offsets of other coordinate systems are not known
+		if !i.wcsWarned {
+			logl.Warnf("Coordinate system changes from %d to %d, moves in it are ignored", i.Start.WCS, block.State.WCS)
+			i.wcsWarned = true
 		}
-		if block.Z != nil {
-			info.Z.Update((*block.Z).Value)
+		return
+	}
+	i.update(block.State.Position, &block.State)
+	if block.State.Motion == Linear {
+		i.updateScan(block.Start, block.State.Position)
+	}
+	for _, axis := range AuxiliaryAxes {
+		if *block.auxiliary(axis) != nil {
+			i.Auxiliary(axis).Update(block.State.Aux.Get(axis))
 		}
 	}
-	logl.Debugf("first=%d last=%d", first, last)
-	info.Setup = (*blocks)[:first]
-	info.Data = (*blocks)[first : last+1]
-	info.Finish = (*blocks)[last+1:]
-	return info
+	if block.IsArc() {
+		arc, err := block.Arc(block.Start)
+		if err != nil {
+			logl.Warnf("Invalid arc %s: %s", block.String(false, false), err)
+			return
+		}
+		for _, p := range arc.Extents() {
+			i.update(p, &block.State)
+		}
+	}
+}
+
+// Adds an XY feed move to the scan directions.
+func (i *Info) updateScan(from Point, to Point) {
+	dx := to.X - from.X
+	dy := to.Y - from.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return
+	}
+	angle := math.Atan2(dy, dx)
+	degree := int(math.Round(angle*180/math.Pi+360)) % 180
+	if math.Cos(angle-float64(degree)*math.Pi/180) < 0 { // the other way along the line
+		dx, dy = -dx, -dy
+	}
+	if i.scans == nil {
+		i.scans = make(map[int]*scanBin)
+	}
+	bin, ok := i.scans[degree]
+	if !ok {
+		bin = &scanBin{}
+		i.scans[degree] = bin
+	}
+	bin.length += length
+	bin.sum.X += dx
+	bin.sum.Y += dy
+}
+
+// Returns the unit XY direction of the scan lines of the data, that of the feed moves covering the
+// greatest length, to the nearest degree and averaged over those moves. X if the data has no XY feed moves.
+func (i *Info) ScanDirection() Point {
+	var best *scanBin
+	for degree := 0; degree < 180; degree++ { // in order so that ties are always broken the same way
+		if bin, ok := i.scans[degree]; ok && (best == nil || bin.length > best.length) {
+			best = bin
+		}
+	}
+	if best == nil {
+		return Point{X: 1}
+	}
+	length := math.Hypot(best.sum.X, best.sum.Y)
+	return Point{X: best.sum.X / length, Y: best.sum.Y / length}
+}
+
+// True if any of the data uses incremental distances.
+func (i *Info) IsIncremental() bool {
+	if i.Start.Distance == Incremental {
+		return true
+	}
+	for _, block := range i.Data {
+		if block.State.Distance == Incremental {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts the data to absolute distances. G90 is added to the setup and G91
+// to the finish when needed so that they are unchanged.
+func (i *Info) Absolute() {
+	i.Data = i.Data.ToAbsolute()
+	if i.Start.Distance == Incremental {
+		block, _ := ParseLine("G90")
+		block.Start = i.Start.Position
+		block.State = i.Start
+		block.State.Distance = Absolute
+		i.Setup = append(i.Setup[:len(i.Setup):len(i.Setup)], block)
+	}
+	if i.End.Distance == Incremental {
+		block, _ := ParseLine("G91")
+		block.Start = i.End.Position
+		block.State = i.End
+		i.Finish = append(Blocks{block}, i.Finish...)
+	}
 }
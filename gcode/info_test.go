@@ -4,6 +4,8 @@ import (
 	"math"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,8 +14,8 @@ func TestInfo(t *testing.T) {
 	info.Init()
 	assert := assert.New(t)
 	t.Run("Init", func(t *testing.T) {
-		assert.EqualValues(math.MaxFloat32, info.Z.Min)
-		assert.EqualValues(-math.MaxFloat32, info.Z.Max)
+		assert.EqualValues(math.MaxFloat64, info.Z.Min)
+		assert.EqualValues(-math.MaxFloat64, info.Z.Max)
 	})
 
 	t.Run("UpdateX", func(t *testing.T) {
@@ -46,3 +48,177 @@ func TestInfo(t *testing.T) {
 		assert.EqualValues(3, passes)
 	})
 }
+
+func TestDepthSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		depths []float64
+		ratio  float64
+		top    float64
+		bottom float64   // below the top
+		want   []float64 // depth of each pass
+		err    bool
+	}{
+		"Uniform":    {ratio: 1, bottom: -10, want: []float64{-3, -6, -9, -10}},
+		"Depths":     {depths: []float64{-4, -7, -9}, ratio: 1, bottom: -10, want: []float64{-4, -7, -9, -10}},
+		"Geometric":  {ratio: 0.5, bottom: -6.1, want: []float64{-3, -4.5, -5.25, -5.75, -6.1}},
+		"Top":        {depths: []float64{-5}, ratio: 1, top: 2, bottom: -10, want: []float64{-5, -8, -10}},
+		"Not deeper": {depths: []float64{-4, -4}, ratio: 1, err: true},
+		"Positive":   {depths: []float64{1}, ratio: 1, err: true},
+		"Ratio":      {ratio: 1.5, err: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			info := Info{Increment: -3, MinCut: 0.5, Top: tc.top}
+			info.Z.Min = tc.bottom + tc.top
+			err := info.ScheduleDepths(tc.depths, tc.ratio)
+			if tc.err {
+				assert.Error(err)
+				return
+			}
+			require.NoError(t, err)
+			passes := info.Passes()
+			depths := make([]float64, passes)
+			for pass := 1; pass <= passes; pass++ {
+				depths[pass-1] = info.PassDepth(pass)
+				assert.EqualValues(pass, info.PassOf(info.Depth(pass)), "PassOf")
+			}
+			assert.EqualValues(tc.want, depths)
+		})
+	}
+}
+
+func TestEvenDepths(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		bottom float64
+		capped bool
+		passes int
+		step   float64
+	}{
+		"Even":         {bottom: -8.189, passes: 3, step: -8.189 / 3},
+		"Exact":        {bottom: -9, passes: 3, step: -3},
+		"Capped":       {bottom: -8.189, capped: true, passes: 4, step: -8.189 / 4},
+		"Capped exact": {bottom: -5, capped: true, passes: 2, step: -2.5},
+		"At the top":   {bottom: 0, passes: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			info := Info{Increment: -3, MinCut: 0.5}
+			info.Z.Min = tc.bottom
+			require.NoError(t, info.EvenDepths(tc.capped))
+			require.EqualValues(t, tc.passes, info.Passes())
+			for pass := 1; pass <= tc.passes; pass++ {
+				assert.InDelta(tc.step, info.Depth(pass)-info.Depth(pass-1), 1e-9, "pass %d", pass)
+			}
+			if tc.passes > 0 {
+				assert.EqualValues(tc.bottom, info.Depth(tc.passes))
+			}
+		})
+	}
+
+	info := Info{Increment: -0.5, MinCut: 0.5}
+	info.Z.Min = -3
+	assert.Error(info.EvenDepths(true), "the cap cannot be met")
+}
+
+func TestInfoAbsolute(t *testing.T) {
+	assert := assert.New(t)
+	blocks := make(Blocks, 0)
+	for _, line := range []string{"G21", "G91", "G0 X1 Y1 Z1", "G1 Z-2", "G0 Z5", "M30"} {
+		b, _ := ParseLine(line)
+		blocks = append(blocks, b)
+	}
+	info := FindInfo(&blocks)
+	assert.True(info.IsIncremental())
+	assert.EqualValues(-1, info.Z.Min)
+	assert.EqualValues(4, info.Z.Max)
+
+	info.Absolute()
+	assert.EqualValues(3, len(info.Setup))
+	assert.EqualValues("G90", info.Setup[2].String(false, false))
+	assert.EqualValues("G91", info.Finish[0].String(false, false))
+	assert.EqualValues("G1Z-1", info.Data[1].String(false, false))
+	assert.EqualValues("G0Z4", info.Data[2].String(false, false))
+	assert.EqualValues("G91", blocks[1].String(false, false), "setup not overwritten")
+	assert.EqualValues("G0 X1 Y1 Z1", blocks[2].String(false, false), "blocks unchanged")
+}
+
+func TestScanDirection(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		lines []string
+		want  Point
+	}{
+		"X raster":        {lines: []string{"G1 X10", "Y1", "X0", "Y2", "X10"}, want: Point{X: 1}},
+		"Y raster":        {lines: []string{"G1 Y10", "X1", "Y0", "X2", "Y10"}, want: Point{Y: 1}},
+		"Diagonal raster": {lines: []string{"G1 X30 Y40", "X26 Y43", "X-4 Y3", "X-8 Y6", "X22 Y46"}, want: Point{X: 0.6, Y: 0.8}},
+		"Rapids":          {lines: []string{"G0 X10", "G1 Y1"}, want: Point{Y: 1}},
+		"No moves":        {lines: []string{"G1 Z-1"}, want: Point{X: 1}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			blocks := Blocks{}
+			for _, line := range append([]string{"G0 X0 Y0 Z1"}, tc.lines...) {
+				b, err := ParseLine(line)
+				require.NoError(t, err)
+				blocks = append(blocks, b)
+			}
+			info := FindInfo(&blocks)
+			scan := info.ScanDirection()
+			assert.InDelta(tc.want.X, scan.X, 1e-9, "X")
+			assert.InDelta(tc.want.Y, scan.Y, 1e-9, "Y")
+		})
+	}
+}
+
+func TestFindSegments(t *testing.T) {
+	assert := assert.New(t)
+	lines := []string{"%", "G21", "T1 M6", "G0 X0 Y0 Z5 M3", "G1 Z-5 F250", "G0 Z5", "M5", "T2", "M6", "M3", "G0 X20 Z5", "G1 Z-7", "G0 Z5", "M5", "M30"}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	segments := FindSegments(&blocks)
+	require.EqualValues(t, 2, len(segments))
+
+	s := segments[0]
+	assert.EqualValues(1, s.Tool)
+	assert.EqualValues(3, len(s.Setup), "header kept with the first tool")
+	assert.EqualValues("T1 M6", s.Setup[2].String(false, false))
+	assert.EqualValues(3, len(s.Data))
+	assert.EqualValues(1, len(s.Finish), "up to the tool select")
+	assert.EqualValues(-5, s.Z.Min)
+
+	s = segments[1]
+	assert.EqualValues(2, s.Tool)
+	assert.EqualValues("T2", s.Setup[0].String(false, false))
+	assert.EqualValues("M6", s.Setup[1].String(false, false))
+	assert.EqualValues(3, len(s.Setup))
+	assert.EqualValues(3, len(s.Data))
+	assert.EqualValues(2, len(s.Finish))
+	assert.EqualValues(-7, s.Z.Min)
+	assert.EqualValues(20, s.X.Min)
+	assert.EqualValues(2, s.Start.Tool, "tool loaded in the setup")
+	assert.EqualValues(SpindleCW, s.Data[0].State.Spindle)
+
+	t.Run("No data", func(t *testing.T) {
+		blocks := Blocks{}
+		for _, line := range []string{"%", "T1 M6", "M30"} {
+			b, _ := ParseLine(line)
+			blocks = append(blocks, b)
+		}
+		segments := FindSegments(&blocks)
+		require.EqualValues(t, 1, len(segments))
+		assert.EqualValues(3, len(segments[0].Setup))
+		assert.EqualValues(0, len(segments[0].Data))
+	})
+}
@@ -0,0 +1,89 @@
+// linearize
+package gcode
+
+import (
+	"math"
+)
+
+// Returns the number of equal segments needed so that the chords of the arc deviate less than tolerance.
+func (a *Arc) Segments(tolerance float64) int {
+	if a.Radius <= tolerance || tolerance <= 0 {
+		return int(math.Ceil(math.Abs(a.Sweep) / (math.Pi / 2))) // never more than a quarter circle
+	}
+	maxAngle := 2 * math.Acos(1-tolerance/a.Radius)
+	return int(math.Max(1, math.Ceil(math.Abs(a.Sweep)/maxAngle)))
+}
+
+// Removes the I, J, K and R words, the G word is left unchanged.
+func (b *Block) RemoveArc() {
+	cmds := make([]CodeCmd, 0, len(b.Cmds))
+	for _, cmd := range b.Cmds {
+		switch cmd.Cmd {
+		case "I", "J", "K", "R":
+			continue
+		}
+		cmds = append(cmds, cmd)
+	}
+	b.Cmds = cmds
+	b.I = nil
+	b.J = nil
+	b.K = nil
+	b.R = nil
+	b.Parse(false)
+}
+
+// Replaces every G02/G03 with G01 segments whose chords deviate at most tolerance from the arc,
+// a tolerance without units is in the units of each block.
+// Helical arcs are linearized with the linear axis interpolated linearly.
+// The blocks must be resolved, blocks that are not arcs are not copied.
+func (bs Blocks) Linearize(tolerance Length) Blocks {
+	result := make(Blocks, 0, len(bs))
+	for _, block := range bs {
+		if !block.IsArc() || block.State.InverseTime { // G93 feeds belong to the whole arc
+			result = append(result, block)
+			continue
+		}
+		arc, err := block.Arc(block.Start)
+		if err != nil {
+			result = append(result, block)
+			continue
+		}
+		result = append(result, block.linearize(&arc, tolerance.In(block.State.Units))...)
+	}
+	return result
+}
+
+// Returns the G01 segments of the arc of the resolved block.
+func (b *Block) linearize(arc *Arc, tolerance float64) Blocks {
+	n := arc.Segments(tolerance)
+	result := make(Blocks, 0, n)
+	from := arc.Start
+	for i := 1; i <= n; i++ {
+		p := arc.PointAt(float64(i) / float64(n))
+		to := p
+		if b.State.Distance == Incremental {
+			p = Point{X: to.X - from.X, Y: to.Y - from.Y, Z: to.Z - from.Z}
+		}
+		var segment Block
+		if i == 1 { // keep the other words of the arc block on the first segment
+			segment = b.Copy()
+			segment.RemoveArc()
+		} else {
+			segment.Init()
+		}
+		segment.Start = from
+		segment.State = b.State
+		segment.BlockDelete = b.BlockDelete
+		segment.State.Motion = Linear
+		segment.State.Position = to
+		segment.SetG(1)
+		segment.SetX(p.X)
+		segment.SetY(p.Y)
+		if arc.Plane != PlaneXY || arc.IsHelical() || segment.Z != nil {
+			segment.SetZ(p.Z)
+		}
+		result = append(result, &segment)
+		from = to
+	}
+	return result
+}
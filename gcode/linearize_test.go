@@ -0,0 +1,89 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinearize(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Segments", func(t *testing.T) {
+		tests := map[string]struct {
+			radius    float64
+			sweep     float64
+			tolerance float64
+			expected  int
+		}{
+			"half circle": {radius: 10, sweep: math.Pi, tolerance: 0.01, expected: 36},
+			"coarse":      {radius: 10, sweep: math.Pi, tolerance: 2.0, expected: 3},
+			"clockwise":   {radius: 10, sweep: -math.Pi, tolerance: 2.0, expected: 3},
+			"tiny radius": {radius: 0.005, sweep: 2 * math.Pi, tolerance: 0.01, expected: 4},
+		}
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				arc := Arc{Radius: tc.radius, Sweep: tc.sweep}
+				assert.EqualValues(tc.expected, arc.Segments(tc.tolerance))
+			})
+		}
+	})
+
+	t.Run("Helix", func(t *testing.T) {
+		b1, _ := ParseLine("G0 X10 Y0 Z0")
+		b2, _ := ParseLine("G3 X-10 Y0 Z-4 I-10 J0 F200 (half)")
+		b3, _ := ParseLine("G1 X0")
+		blocks := Blocks{b1, b2, b3}
+		blocks.Resolve()
+		got := blocks.Linearize(Length{Value: 0.05})
+		require.Greater(t, len(got), 4)
+		assert.Same(b1, got[0])
+		assert.Same(b3, got[len(got)-1])
+
+		segments := got[1 : len(got)-1]
+		assert.EqualValues(200, segments[0].F.Value, "feed kept")
+		assert.Contains(segments[0].String(false, false), "(half)", "comment kept")
+		pos := Point{X: 10, Y: 0, Z: 0}
+		for i, s := range segments {
+			require.EqualValues(t, 1, s.G.Value, "G1")
+			assert.Empty(s.I, "I removed")
+			assert.Empty(s.J, "J removed")
+			end := s.EndPoint(pos)
+			r := math.Hypot(float64(end.X), float64(end.Y))
+			assert.InDelta(10, r, 1e-3, "on arc")
+			// deviation of the chord mid point
+			mid := math.Hypot(float64(end.X+pos.X)/2, float64(end.Y+pos.Y)/2)
+			assert.LessOrEqual(10-mid, 0.05+1e-5, "chord tolerance")
+			assert.InDelta(-4*float64(i+1)/float64(len(segments)), end.Z, 1e-4, "Z interpolated")
+			pos = end
+		}
+		assert.InDelta(-10, pos.X, 1e-4)
+		assert.InDelta(0, pos.Y, 1e-4)
+	})
+
+	t.Run("Planar", func(t *testing.T) {
+		b1, _ := ParseLine("G0 X1 Y0")
+		b2, _ := ParseLine("G2 X-1 Y0 R1")
+		blocks := Blocks{b1, b2}
+		blocks.Resolve()
+		got := blocks.Linearize(Length{Value: 0.5})
+		for _, s := range got[1:] {
+			assert.Empty(s.Z, "no Z on planar arc")
+		}
+	})
+
+	t.Run("Tolerance units", func(t *testing.T) {
+		b0, _ := ParseLine("G20")
+		b1, _ := ParseLine("G0 X1 Y0")
+		b2, _ := ParseLine("G2 X-1 Y0 R1")
+		blocks := Blocks{b0, b1, b2}
+		blocks.Resolve()
+		inches := blocks.Linearize(Length{Value: 0.01})
+		millimetres := blocks.Linearize(Length{Value: 0.254, Units: Millimetres, HasUnits: true})
+		assert.Equal(len(inches), len(millimetres), "0.254mm is 0.01in")
+		assert.Greater(len(blocks.Linearize(Length{Value: 0.01, Units: Millimetres, HasUnits: true})), len(inches), "0.01mm is finer")
+	})
+}
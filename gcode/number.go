@@ -0,0 +1,122 @@
+// number
+package gcode
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	numberWord   = regexp.MustCompile(`^\s*(/?)\s*[Nn]\d+\s*`)
+	checksumWord = regexp.MustCompile(`\s*\*\d+\s*$`)
+	parenComment = regexp.MustCompile(`\([^)]*\)`)
+)
+
+// Returns the checksum of the text before a '*', the exclusive or of its bytes.
+func Checksum(text string) int {
+	sum := 0
+	for _, b := range []byte(text) {
+		sum ^= int(b)
+	}
+	return sum
+}
+
+// Returns a map from the source line number to the first block read from the line.
+func (bs Blocks) ByLine() map[int]*Block {
+	lines := make(map[int]*Block)
+	for _, block := range bs {
+		if _, ok := lines[block.Line]; !ok && block.Line != 0 {
+			lines[block.Line] = block
+		}
+	}
+	return lines
+}
+
+// Numberer writes lines to w with N words numbered from Next by Step if Renumber is set, after
+// the '/' of block delete, and a checksum at the end of each line if Checksum is set, before a ';'
+// comment. Lines with only comments have no checksum. N words and checksums already in a line are
+// replaced. Blank lines and '%' lines are written as they are.
+type Numberer struct {
+	Renumber bool
+	Checksum bool
+	Next     int
+	Step     int
+	w        io.Writer
+	line     []byte // written after its end
+}
+
+func NewNumberer(w io.Writer, start int, step int) *Numberer {
+	return &Numberer{Next: start, Step: step, w: w}
+}
+
+func (n *Numberer) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b != '\n' {
+			n.line = append(n.line, b)
+			continue
+		}
+		if err := n.writeLine(string(n.line)); err != nil {
+			return i, err
+		}
+		n.line = n.line[:0]
+	}
+	return len(p), nil
+}
+
+// Writes the last line if it has no end.
+func (n *Numberer) Flush() error {
+	if len(n.line) == 0 {
+		return nil
+	}
+	err := n.writeLine(string(n.line))
+	n.line = n.line[:0]
+	return err
+}
+
+func (n *Numberer) writeLine(line string) error {
+	text := strings.TrimRight(line, "\r")
+	if trimmed := strings.TrimSpace(text); trimmed == "" || strings.HasPrefix(trimmed, "%") {
+		_, err := fmt.Fprintln(n.w, line)
+		return err
+	}
+	text, comment := splitComment(text)
+	text = checksumWord.ReplaceAllString(text, "") // it would no longer match
+	hasCode := strings.Trim(numberWord.ReplaceAllString(parenComment.ReplaceAllString(text, ""), ""), " \t/") != ""
+	if n.Renumber {
+		text = numberWord.ReplaceAllString(text, "$1") // keeping the block delete
+		deleted := strings.HasPrefix(text, "/")
+		text = strings.TrimRight(fmt.Sprintf("N%d %s", n.Next, strings.TrimPrefix(text, "/")), " ")
+		if deleted {
+			text = "/" + text
+		}
+		n.Next += n.Step
+	}
+	if n.Checksum && hasCode {
+		text = fmt.Sprintf("%s*%d", text, Checksum(text))
+	}
+	if text != "" && comment != "" {
+		comment = " " + comment
+	}
+	_, err := fmt.Fprintln(n.w, text+comment)
+	return err
+}
+
+// Returns the text before a ';' comment outside parentheses without trailing spaces, and the comment.
+func splitComment(text string) (string, string) {
+	depth := 0
+	for i, r := range text {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ';':
+			if depth <= 0 {
+				return strings.TrimRight(text[:i], " \t"), text[i:]
+			}
+		}
+	}
+	return strings.TrimRight(text, " \t"), ""
+}
@@ -0,0 +1,91 @@
+package gcode
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualValues(0, Checksum(""))
+	assert.EqualValues(63, Checksum("G1 X1"))
+	assert.EqualValues('N', Checksum("N"))
+}
+
+func TestParseNumbered(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		line   string
+		number int
+		x      float64
+	}{
+		"Deleted":  {line: "/N7 G1 X4*" + strconv.Itoa(Checksum("/N7 G1 X4")), number: 7, x: 4},
+		"None":     {line: "G1 X1", number: -1, x: 1},
+		"Number":   {line: "N20 G1 X2", number: 20, x: 2},
+		"Checksum": {line: "G1 X1*63", number: -1, x: 1},
+		"Both":     {line: "N5 G1 X3*" + strconv.Itoa(Checksum("N5 G1 X3")), number: 5, x: 3},
+		"Trailing": {line: "G1 X1*63  ", number: -1, x: 1},
+		"Comment":  {line: "G1 X1*63 ;cut", number: -1, x: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := ParseLine(tc.line)
+			require.NoError(t, err)
+			assert.EqualValues(tc.number, b.Number())
+			require.NotNil(t, b.X)
+			assert.EqualValues(tc.x, b.X.Value)
+			assert.Equal(strings.HasPrefix(tc.line, "/"), b.BlockDelete)
+		})
+	}
+
+	b, err := ParseLine("/N7 G1 X4")
+	require.NoError(t, err)
+	b.SetX(5)
+	assert.EqualValues("/N7G1X5", b.String(false, false), "still deleted")
+}
+
+func TestByLine(t *testing.T) {
+	assert := assert.New(t)
+	r := NewReader(strings.NewReader("N10 G0 X1\n\nN20 G1 X2\n"))
+	blocks, _, _ := r.ReadAll()
+	lines := blocks.ByLine()
+	require.Contains(t, lines, 3)
+	assert.EqualValues(20, lines[3].Number())
+	assert.EqualValues(10, lines[1].Number())
+}
+
+func TestNumberer(t *testing.T) {
+	assert := assert.New(t)
+	text := "%\nN5 G21\n\nG0 X1*12\n;Pass 1\n(roughing)\n/N7 G0 X2\nG1 Z-1 ;slow"
+
+	tests := map[string]struct {
+		renumber bool
+		checksum bool
+		want     string
+	}{
+		"Renumber": {renumber: true, want: "%\nN100 G21\n\nN105 G0 X1\nN110 ;Pass 1\nN115 (roughing)\n/N120 G0 X2\nN125 G1 Z-1 ;slow\n"},
+		"Checksum": {checksum: true, want: "%\nN5 G21*" + strconv.Itoa(Checksum("N5 G21")) + "\n\nG0 X1*" + strconv.Itoa(Checksum("G0 X1")) + "\n;Pass 1\n(roughing)\n/N7 G0 X2*" +
+			strconv.Itoa(Checksum("/N7 G0 X2")) + "\nG1 Z-1*" + strconv.Itoa(Checksum("G1 Z-1")) + " ;slow\n"},
+		"Both": {renumber: true, checksum: true, want: "%\nN100 G21*" + strconv.Itoa(Checksum("N100 G21")) + "\n\nN105 G0 X1*" + strconv.Itoa(Checksum("N105 G0 X1")) + "\nN110 ;Pass 1\nN115 (roughing)\n/N120 G0 X2*" +
+			strconv.Itoa(Checksum("/N120 G0 X2")) + "\nN125 G1 Z-1*" + strconv.Itoa(Checksum("N125 G1 Z-1")) + " ;slow\n"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var sb strings.Builder
+			n := NewNumberer(&sb, 100, 5)
+			n.Renumber = tc.renumber
+			n.Checksum = tc.checksum
+			_, err := n.Write([]byte(text))
+			require.NoError(t, err)
+			require.NoError(t, n.Flush())
+			assert.Equal(tc.want, sb.String())
+		})
+	}
+}
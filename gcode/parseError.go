@@ -0,0 +1,31 @@
+// parseError
+package gcode
+
+import (
+	"fmt"
+)
+
+// ParseError is a failure to parse a word of a line. Line and Column start at 1,
+// Line is 0 when the line number is not known, e.g. from ParseLine.
+type ParseError struct {
+	Line   int
+	Column int // rune column of the start of the word
+	Word   string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	position := fmt.Sprintf("column %d", e.Column)
+	if e.Line > 0 {
+		position = fmt.Sprintf("line %d %s", e.Line, position)
+	}
+	if e.Word == "" {
+		return fmt.Sprintf("%s: %s", position, e.Reason)
+	}
+	return fmt.Sprintf("%s '%s': %s", position, e.Word, e.Reason)
+}
+
+// Returns a ParseError for the parsed command.
+func newParseError(cmd *CodeCmd, reason string) *ParseError {
+	return &ParseError{Column: cmd.Column, Word: cmd.String(false), Reason: reason}
+}
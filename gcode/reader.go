@@ -0,0 +1,129 @@
+// reader
+package gcode
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Reader parses blocks from lines of text, keeping count of the lines for errors.
+// The blocks are resolved as they are read so they can be used one at a time.
+type Reader struct {
+	Lenient      bool           // keep unknown words instead of failing
+	Expand       bool           // evaluate LinuxCNC parameters, expressions and O-word control flow
+	Unrecognised map[string]int // count of the unknown words kept by lenient parsing
+	scanner      *bufio.Scanner
+	line         int
+	expanded     []Line // lines still to be parsed when expanding
+	expandErr    error  // error of the expansion, returned after the lines expanded before it
+	state        State  // state after the last block read
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{Unrecognised: make(map[string]int), scanner: bufio.NewScanner(r), state: NewState()}
+}
+
+// Returns the modal state after the last block read.
+func (r *Reader) State() State {
+	return r.state
+}
+
+// Returns the line number of the last line read.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Returns the next line of the input, or of the expanded program if expanding.
+func (r *Reader) next() (Line, error) {
+	if !r.Expand {
+		if r.scanner.Scan() {
+			r.line++
+			return Line{Text: r.scanner.Text(), Number: r.line}, nil
+		}
+		if r.scanner.Err() != nil {
+			return Line{}, r.scanner.Err()
+		}
+		return Line{}, io.EOF
+	}
+
+	if r.expanded == nil { // the whole program is needed for the control flow
+		lines := make([]Line, 0)
+		for r.scanner.Scan() {
+			lines = append(lines, Line{Text: r.scanner.Text(), Number: len(lines) + 1})
+		}
+		if r.scanner.Err() != nil {
+			return Line{}, r.scanner.Err()
+		}
+		r.expanded, r.expandErr = NewExpander(lines).Expand()
+	}
+	if len(r.expanded) == 0 {
+		err := r.expandErr
+		r.expandErr = nil
+		if err == nil {
+			err = io.EOF
+		}
+		return Line{}, err
+	}
+	line := r.expanded[0]
+	r.expanded = r.expanded[1:]
+	r.line = line.Number
+	return line, nil
+}
+
+// Returns the block of the next line that is not blank, io.EOF at the end of the input.
+// A line that fails to parse returns a *ParseError with the line number set.
+// The line number of the source and the resolved state are set on the block.
+func (r *Reader) Read() (*Block, error) {
+	for {
+		line, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		txt := line.Text
+		if len(strings.TrimSpace(txt)) == 0 { // ignore blank lines
+			continue
+		}
+		block, err := parseLine(txt, r.Lenient)
+		block.Line = line.Number
+		for _, cmd := range block.Cmds {
+			if cmd.Type == Opaque {
+				r.Unrecognised[cmd.Unrecognised()]++
+			}
+		}
+		if err != nil {
+			var pe *ParseError
+			if errors.As(err, &pe) {
+				pe.Line = r.line
+			}
+			return block, err
+		}
+		block.Start = r.state.Position
+		r.state.Update(block)
+		block.State = r.state
+		return block, nil
+	}
+}
+
+// Reads all the blocks, lines that fail to parse are left out and their errors collected.
+// The error is only set if reading the input fails.
+func (r *Reader) ReadAll() (Blocks, []*ParseError, error) {
+	blocks := make(Blocks, 0)
+	parseErrors := make([]*ParseError, 0)
+	for {
+		block, err := r.Read()
+		if err == io.EOF {
+			return blocks, parseErrors, nil
+		}
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			parseErrors = append(parseErrors, pe)
+			continue
+		}
+		if err != nil {
+			return blocks, parseErrors, err
+		}
+		blocks = append(blocks, block)
+	}
+}
@@ -0,0 +1,138 @@
+package gcode
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseError(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		line   string
+		column int
+		word   string
+	}{
+		"Unexpected":   {line: "G1 X2 E5", column: 7, word: "E"},
+		"Unsupported":  {line: "G1 X2\tG95", column: 7, word: "G95"},
+		"Invalid":      {line: "G1 X-", column: 4, word: "X-"},
+		"Address":      {line: "G90.12", column: 1, word: "G90.12"},
+		"Multiple":     {line: "G1 X1 X2", column: 7, word: "X2"},
+		"R and I":      {line: "G2 X1 I1 R1", column: 10, word: "R1"},
+		"Block delete": {line: "G1 /bla", column: 4, word: "/"},
+		"N position":   {line: "G1 N10 X1", column: 4, word: "N10"},
+		"Checksum":     {line: "N10 G1 X1*3", column: 10, word: "*3"},
+		"Not last":     {line: "G1 X1*63 Y1", column: 6, word: "*63"},
+		"Deleted":      {line: "/N10 G1 X1*3", column: 11, word: "*3"},
+		"Two deletes":  {line: "//G1 X1", column: 2, word: "/"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseLine(tc.line)
+			var pe *ParseError
+			require.True(t, errors.As(err, &pe), "not a ParseError: %v", err)
+			assert.EqualValues(0, pe.Line)
+			assert.EqualValues(tc.column, pe.Column, "Column")
+			assert.EqualValues(tc.word, pe.Word, "Word")
+			assert.NotEmpty(pe.Reason)
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+	text := "%\n\nG0 X1\nG1 X2 E5\n  \nG1 X1 X2\nG1 Y1\n"
+
+	t.Run("Read", func(t *testing.T) {
+		r := NewReader(strings.NewReader(text))
+		b, err := r.Read()
+		require.Empty(t, err)
+		assert.EqualValues(Percent, b.Cmds[0].Type)
+		b, err = r.Read()
+		require.Empty(t, err)
+		assert.EqualValues(1, b.X.Value)
+		assert.EqualValues(3, r.Line())
+		_, err = r.Read()
+		var pe *ParseError
+		require.True(t, errors.As(err, &pe))
+		assert.EqualValues(4, pe.Line)
+		assert.EqualValues("line 4 column 7 'E': Unexpected character E", pe.Error())
+	})
+
+	t.Run("ReadAll", func(t *testing.T) {
+		r := NewReader(strings.NewReader(text))
+		blocks, parseErrors, err := r.ReadAll()
+		require.Empty(t, err)
+		assert.EqualValues(3, len(blocks))
+		require.EqualValues(t, 2, len(parseErrors))
+		assert.EqualValues(4, parseErrors[0].Line)
+		assert.EqualValues(6, parseErrors[1].Line)
+		assert.EqualValues(7, parseErrors[1].Column)
+		_, err = r.Read()
+		assert.Equal(io.EOF, err)
+	})
+}
+
+func TestLenient(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("ParseLine", func(t *testing.T) {
+		_, err := ParseLine("G43 H1 Z5")
+		assert.NotEmpty(err, "strict")
+
+		b, err := ParseLineLenient("G43 h1 Z5")
+		require.Empty(t, err)
+		require.EqualValues(t, 3, len(b.Cmds))
+		assert.EqualValues(CodeCmd{Cmd: "G43", Value: 43, Type: Opaque, Column: 1, Source: "G43"}, b.Cmds[0])
+		assert.EqualValues(CodeCmd{Cmd: "h1", Type: Opaque, Column: 5, Source: "h1"}, b.Cmds[1])
+		assert.Nil(b.Z, "not known to be a move")
+		assert.Equal(&b.Cmds[0], b.AxisCmd)
+		assert.EqualValues("G43 h1 Z5", b.String(false, false))
+		assert.EqualValues("G43 h1 Z5.000 ", b.String(false, true))
+
+		_, err = ParseLineLenient("G1 X#1")
+		assert.NotEmpty(err, "not a letter")
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		r := NewReader(strings.NewReader("G43 H1\nG1 X1 E0.5\nG1 X2 E1\nM66 P1\n"))
+		r.Lenient = true
+		blocks, parseErrors, err := r.ReadAll()
+		require.Empty(t, err)
+		assert.Empty(parseErrors)
+		assert.EqualValues(4, len(blocks))
+		assert.EqualValues(map[string]int{"G43": 1, "H": 1, "E": 2, "M66": 1}, r.Unrecognised)
+	})
+
+	t.Run("Unsupported code", func(t *testing.T) {
+		r := NewReader(strings.NewReader("G0 X0 Y0 Z5\nG1 X10 Y10 Z-1 F100\nG53 G0 X-400 Y-300\nG0 Z5\nG0 X0 Y0\nG1 Z-1\n"))
+		r.Lenient = true
+		blocks, _, err := r.ReadAll()
+		require.Empty(t, err)
+		blocks.Resolve()
+
+		g53 := blocks[2]
+		assert.False(g53.IsMove(), "not a move")
+		assert.False(g53.State.KnownX)
+		assert.False(g53.State.KnownY)
+		assert.True(g53.State.KnownZ)
+		assert.EqualValues(Point{X: 10, Y: 10, Z: -1}, g53.State.Position)
+
+		info := FindSegments(&blocks)[0]
+		assert.EqualValues(0, info.X.Min, "left out of the ranges")
+		assert.EqualValues(10, info.X.Max)
+		assert.EqualValues(0, info.Y.Min)
+
+		g53.Reposition(5, 5)
+		assert.EqualValues("G53 G0 X-400 Y-300", g53.String(false, false), "printed from the source")
+		g53.ToStepZ(&info, 1)
+		assert.Nil(g53.Z)
+	})
+}
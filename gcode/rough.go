@@ -0,0 +1,183 @@
+// rough
+package gcode
+
+import (
+	"errors"
+	"math"
+)
+
+// Default stepover of heightmap roughing as a fraction of the tool diameter.
+const DefaultStepover = 0.4
+
+// roughing collects the moves of a roughing toolpath.
+type roughing struct {
+	state  State
+	blocks Blocks
+	feed   float64
+	safe   float64 // Z of rapids between cuts
+	up     bool    // at the safe Z
+}
+
+// Adds a block with the G code and words.
+func (r *roughing) emit(code float64, axes ...CodeCmd) {
+	block := new(Block)
+	block.Cmds = append([]CodeCmd{{Cmd: "G", Value: code, Type: Address}}, axes...)
+	if code != 0 && r.state.Feed != r.feed {
+		block.Cmds = append(block.Cmds, CodeCmd{Cmd: "F", Value: r.feed, Type: ValueFloat})
+	}
+	block.Parse(false)
+	block.Start = r.state.Position
+	r.state.Update(block)
+	block.State = r.state
+	r.blocks = append(r.blocks, block)
+}
+
+// Rapids up to the safe Z unless already there.
+func (r *roughing) retract() {
+	if !r.up {
+		r.emit(0, axisWord("Z", r.safe))
+		r.up = true
+	}
+}
+
+// Cuts along a run of samples of a row, only the samples where the slope changes are moved to.
+func (r *roughing) cut(info *Info, xs []float64, y float64, zs []float64) {
+	r.retract()
+	r.emit(0, axisWord("X", xs[0]), axisWord("Y", y))
+	start := Point{X: xs[0], Y: y, Z: zs[0]}
+	down := false
+	for i := 1; i < len(xs); i++ {
+		last := i == len(xs)-1
+		if last || !Near(zs[i+1]-zs[i], zs[i]-zs[i-1], DefaultTolerance) {
+			if !down {
+				r.enter(info, start, Point{X: xs[i], Y: y, Z: zs[i]})
+				down = true
+			}
+			r.emit(1, axisWord("X", xs[i]), axisWord("Z", zs[i]))
+		}
+	}
+	if !down { // a single sample
+		r.enter(info, start, start)
+	}
+}
+
+// Goes down from the safe Z to the point at the entry feed, ramping along the cut to next if the entry
+// is a ramp and there is room, plunging otherwise. Helices are not used as the room for them is not known.
+func (r *roughing) enter(info *Info, at Point, next Point) {
+	feed := r.feed
+	if info.EntryFeed > 0 {
+		feed = info.EntryFeed
+	}
+	var moves Blocks
+	if info.Entry == Ramp {
+		from := r.state
+		from.Position = at
+		to := from
+		to.Position = next
+		to.Motion = Linear
+		moves = info.EntryMoves(&from, &to, r.safe, feed)
+	}
+	if moves != nil {
+		r.blocks = append(r.blocks, moves...)
+		r.state = moves[len(moves)-1].State
+	} else {
+		cut := r.feed
+		r.feed = feed
+		r.emit(1, axisWord("Z", at.Z))
+		r.feed = cut
+	}
+	r.up = false
+}
+
+// Returns the moves of a flat end mill roughing the surface down the passes in rows along X stepped in Y by
+// stepover, leaving MinCut normal to the surface. Only the material below the previous pass is cut, the tool
+// rises to SkipHeight above Top between cuts. The moves start and end at that height and are in the frame
+// of the start of the data, in absolute distances. Surface must have been mapped.
+func (i *Info) RoughSurface(tool Tool, stepover float64) (Blocks, error) {
+	if i.Surface == nil {
+		return nil, errors.New("Roughing needs the surface of the finish tool")
+	}
+	if tool.Shape != FlatEnd {
+		return nil, errors.New("Roughing is with a flat end mill")
+	}
+	if err := tool.Validate(); err != nil {
+		return nil, err
+	}
+	if stepover <= 0 || stepover > tool.Diameter {
+		return nil, errors.New("Stepover must be positive and at most the diameter of the tool")
+	}
+	h := i.Surface
+	k := NewKernel(tool.Grown(i.MinCut), h.Cell)
+	state := i.Start
+	state.Distance = Absolute
+	state.Motion = Rapid
+	r := roughing{state: state, blocks: make(Blocks, 0), feed: i.FeedRate, safe: i.Top + i.SkipHeight, up: true}
+
+	xs := samples(i.X, h.Cell)
+	ys := samples(i.Y, stepover)
+	floors := make([][]float64, len(ys)) // lowest Z of the tip over each sample
+	for row, y := range ys {
+		floors[row] = make([]float64, len(xs))
+		for col, x := range xs {
+			floors[row][col] = h.Drop(k, x, y)
+		}
+	}
+
+	previous := i.Top
+	passes := i.Passes()
+	for pass := 1; pass <= passes; pass++ {
+		level := i.Top + i.PassDepth(pass)
+		for row, y := range ys {
+			zs := make([]float64, len(xs))
+			for col := range xs {
+				zs[col] = math.Max(level, floors[row][col])
+			}
+			runs := make([][2]int, 0) // of samples below the previous pass
+			for col := 0; col < len(xs); col++ {
+				if zs[col] >= previous-i.Tolerance {
+					continue
+				}
+				start := col
+				for col+1 < len(xs) && zs[col+1] < previous-i.Tolerance {
+					col++
+				}
+				runs = append(runs, [2]int{start, col + 1})
+			}
+			if row%2 == 0 {
+				for _, run := range runs {
+					r.cut(i, xs[run[0]:run[1]], y, zs[run[0]:run[1]])
+				}
+				continue
+			}
+			for j := len(runs) - 1; j >= 0; j-- { // back along the next row
+				run := runs[j]
+				r.cut(i, reversed(xs[run[0]:run[1]]), y, reversed(zs[run[0]:run[1]]))
+			}
+		}
+		previous = level
+	}
+	r.retract()
+	return r.blocks, nil
+}
+
+// Returns values from the minimum to the maximum of the range no further apart than step, both ends included.
+func samples(mm MinMax, step float64) []float64 {
+	n := int(math.Ceil((mm.Max-mm.Min)/step - DefaultTolerance))
+	if n < 1 {
+		return []float64{mm.Min}
+	}
+	values := make([]float64, n+1)
+	for i := range values {
+		values[i] = mm.Min + (mm.Max-mm.Min)*float64(i)/float64(n)
+	}
+	return values
+}
+
+// Returns a copy of the values in reverse order.
+func reversed(values []float64) []float64 {
+	result := make([]float64, len(values))
+	for i, v := range values {
+		result[len(values)-1-i] = v
+	}
+	return result
+}
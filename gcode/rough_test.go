@@ -0,0 +1,140 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the info of a square pocket from X5 Y5 to X15 Y15 down to Z-5.
+func pocketInfo(t *testing.T) Info {
+	info := Info{Increment: -3, MinCut: 0.5, SkipHeight: 1, FeedRate: 300, Tolerance: DefaultTolerance, Start: NewState()}
+	info.Init()
+	info.X.Update(0)
+	info.X.Update(20)
+	info.Y.Update(0)
+	info.Y.Update(20)
+	info.Z.Update(-5)
+	require.NoError(t, info.NewSurface(Tool{Shape: FlatEnd, Diameter: 1}, 0.25))
+	h := info.Surface
+	for row := 0; row < h.Rows; row++ {
+		for col := 0; col < h.Cols; col++ {
+			x := h.X0 + float64(col)*h.Cell
+			y := h.Y0 + float64(row)*h.Cell
+			if x > 5 && x < 15 && y > 5 && y < 15 {
+				h.Z[row*h.Cols+col] = -5
+			}
+		}
+	}
+	return info
+}
+
+func TestRoughSurface(t *testing.T) {
+	assert := assert.New(t)
+	info := pocketInfo(t)
+	tool := Tool{Shape: FlatEnd, Diameter: 4}
+
+	blocks, err := info.RoughSurface(tool, 1.5)
+	require.NoError(t, err)
+	require.NotEmpty(t, blocks)
+
+	k := NewKernel(tool.Grown(info.MinCut), info.Surface.Cell)
+	levels := make(map[float64]int)
+	for _, b := range blocks {
+		p := b.State.Position
+		if b.State.Motion == Linear {
+			assert.GreaterOrEqual(p.Z, info.Surface.Drop(k, p.X, p.Y)-1e-9, "clear of the surface at X%g Y%g", p.X, p.Y)
+			assert.True(p.X >= 7.5-1e-9 && p.X <= 12.5+1e-9, "X%g inside the pocket", p.X)
+			levels[p.Z]++
+		} else if b.Z != nil {
+			assert.EqualValues(1, p.Z, "rapids at the skip height")
+		}
+	}
+	assert.Contains(levels, -3.0, "first pass")
+	assert.Contains(levels, -4.5, "last pass leaving MinCut")
+	assert.Len(levels, 2)
+
+	last := blocks[len(blocks)-1]
+	assert.EqualValues(0, last.State.Motion)
+	assert.EqualValues(1, last.State.Position.Z, "ends at the skip height")
+	assert.EqualValues(300, blocks[1].State.Feed)
+
+	t.Run("Entries", func(t *testing.T) {
+		plunges := func(blocks Blocks) []*Block {
+			result := make([]*Block, 0)
+			for _, b := range blocks {
+				if b.State.Motion == Linear && b.State.Position.X == b.Start.X && b.State.Position.Y == b.Start.Y {
+					result = append(result, b)
+				}
+			}
+			return result
+		}
+		entry := info
+		entry.EntryFeed = 100
+		blocks, err := entry.RoughSurface(tool, 1.5)
+		require.NoError(t, err)
+		require.NotEmpty(t, plunges(blocks))
+		for _, b := range plunges(blocks) {
+			assert.EqualValues(100, b.State.Feed, "plunge at the entry feed")
+		}
+		assert.EqualValues(300, blocks[len(blocks)-2].State.Feed, "cut at the feed")
+
+		entry.Entry = Ramp
+		entry.EntryAngle = 10
+		blocks, err = entry.RoughSurface(tool, 1.5)
+		require.NoError(t, err)
+		assert.Empty(plunges(blocks), "ramped along the rows")
+		for _, b := range blocks {
+			p := b.State.Position
+			if b.State.Motion == Linear && p.Z < b.Start.Z {
+				angle := math.Atan2(b.Start.Z-p.Z, math.Hypot(p.X-b.Start.X, p.Y-b.Start.Y)) * 180 / math.Pi
+				assert.LessOrEqual(angle, 10+1e-9, "ramp at X%g Y%g", p.X, p.Y)
+			}
+		}
+
+		entry.EntryAngle = 1
+		blocks, err = entry.RoughSurface(tool, 1.5)
+		require.NoError(t, err)
+		assert.NotEmpty(plunges(blocks), "no room to ramp")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := info.RoughSurface(tool, 0)
+		assert.Error(err, "no stepover")
+		_, err = info.RoughSurface(Tool{Shape: BallEnd, Diameter: 4}, 1)
+		assert.Error(err, "not flat")
+		_, err = (&Info{}).RoughSurface(tool, 1)
+		assert.Error(err, "no surface")
+	})
+}
+
+func TestSamples(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualValues([]float64{0, 2.5, 5, 7.5, 10}, samples(MinMax{Min: 0, Max: 10}, 3))
+	assert.EqualValues([]float64{0, 5, 10}, samples(MinMax{Min: 0, Max: 10}, 5))
+	assert.EqualValues([]float64{1}, samples(MinMax{Min: 1, Max: 1}, 5))
+}
+
+func TestRoughStock(t *testing.T) {
+	assert := assert.New(t)
+	info := pocketInfo(t)
+	tool := Tool{Shape: FlatEnd, Diameter: 4}
+	blocks, err := info.RoughSurface(tool, 1.5)
+	require.NoError(t, err)
+	info.RoughStock(tool, blocks)
+
+	at := func(x float64, y float64, z float64) *State {
+		return &State{Position: Point{X: x, Y: y, Z: z}, KnownX: true, KnownY: true, KnownZ: true}
+	}
+	col, row := info.Stock.cell(10, 10)
+	assert.InDelta(-4.5, info.Stock.At(col, row), 1e-9, "roughed leaving MinCut")
+	col, row = info.Stock.cell(1, 1)
+	assert.EqualValues(0, info.Stock.At(col, row), "outside the pocket")
+
+	assert.InDelta(0.3, info.Engagement(at(10, 10, -4.8), at(10, 12, -4.8)), 1e-9, "floor")
+	assert.InDelta(4.8, info.Engagement(at(5.25, 8, -4.8), at(5.25, 12, -4.8)), 1e-9, "beside the wall")
+	info.CutStock(at(5.25, 8, -4.8), at(5.25, 12, -4.8))
+	assert.InDelta(0, info.Engagement(at(5.25, 9, -4.8), at(5.25, 11, -4.8)), 1e-9, "cut")
+}
@@ -25,7 +25,8 @@ func (rs *RunesScanner) Rune() rune {
 	return r
 }
 
-func (rs *RunesScanner) GetValue(cmdType CmdType) (value float32, err error) {
+// Returns the runes of a number at the current position.
+func (rs *RunesScanner) ValueRunes() []rune {
 	valueRunes := make([]rune, 0)
 	for rs.Scan() {
 		r := rs.runes[rs.index]
@@ -36,18 +37,38 @@ func (rs *RunesScanner) GetValue(cmdType CmdType) (value float32, err error) {
 			break
 		}
 	}
+	return valueRunes
+}
+
+func (rs *RunesScanner) GetValue(cmdType CmdType) (value float64, err error) {
+	valueRunes := rs.ValueRunes()
 	switch cmdType {
-	case ValueInt, Address:
+	case Address:
+		{
+			str := string(valueRunes)
+			value, err = strconv.ParseFloat(str, 64)
+			if err != nil {
+				err = errors.New("Invalid address " + str)
+			}
+			if dot := strings.IndexRune(str, '.'); err == nil && dot >= 0 && len(str)-dot != 2 { // G90.1 has one decimal digit
+				err = errors.New("Invalid address " + str)
+			}
+		}
+	case ValueInt:
 		{
 			var vi int64
 			vi, err = strconv.ParseInt(string(valueRunes), 10, 32)
-			value = float32(vi)
+			if err != nil {
+				err = errors.New("Invalid integer " + string(valueRunes))
+			}
+			value = float64(vi)
 		}
 	case ValueFloat:
 		{
-			var vf float64
-			vf, err = strconv.ParseFloat(string(valueRunes), 10)
-			value = float32(vf)
+			value, err = strconv.ParseFloat(string(valueRunes), 64)
+			if err != nil {
+				err = errors.New("Invalid number " + string(valueRunes))
+			}
 		}
 	default:
 		{
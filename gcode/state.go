@@ -1,5 +1,383 @@
 // state
 package gcode
 
-type state struct {
+import (
+	"math"
+)
+
+type Motion int
+
+const (
+	Rapid Motion = iota
+	Linear
+	ArcCW
+	ArcCCW
+)
+
+// G code word selecting the motion.
+func (m Motion) Code() float64 {
+	return float64(m)
+}
+
+type Spindle int
+
+const (
+	SpindleOff Spindle = iota
+	SpindleCW
+	SpindleCCW
+)
+
+type Units int
+
+const (
+	Millimetres Units = iota
+	Inches
+)
+
+type Distance int
+
+const (
+	Absolute Distance = iota
+	Incremental
+)
+
+type Plane int
+
+const (
+	PlaneXY Plane = iota
+	PlaneZX
+	PlaneYZ
+)
+
+// Auxiliary is the position of the rotary axes A/B/C in degrees and the linear axes U/V/W.
+type Auxiliary struct {
+	A float64
+	B float64
+	C float64
+	U float64
+	V float64
+	W float64
+}
+
+// The names of the rotary and auxiliary linear axes.
+var AuxiliaryAxes = []string{"A", "B", "C", "U", "V", "W"}
+
+// Returns the position of the named axis.
+func (a *Auxiliary) Get(axis string) float64 {
+	return *a.field(axis)
+}
+
+func (a *Auxiliary) field(axis string) *float64 {
+	switch axis {
+	case "A":
+		return &a.A
+	case "B":
+		return &a.B
+	case "C":
+		return &a.C
+	case "U":
+		return &a.U
+	case "V":
+		return &a.V
+	}
+	return &a.W
+}
+
+// State is the modal state of the machine after a block has been executed.
+type State struct {
+	Position    Point
+	Aux         Auxiliary // rotary and auxiliary linear axes, zero until set
+	KnownX      bool      // false until the axis has been set by a block
+	KnownY      bool
+	KnownZ      bool
+	Motion      Motion
+	Feed        float64
+	Speed       float64
+	Spindle     Spindle
+	Mist        bool // M07
+	Flood       bool // M08
+	Tool        int  // loaded by M06
+	NextTool    int  // selected by T
+	Units       Units
+	Distance    Distance
+	ArcIJK      bool // true for G90.1 absolute arc centers
+	InverseTime bool // true for G93 inverse time feeds
+	Plane       Plane
+	WCS         int   // work coordinate system, 1 for G54 to 9 for G59.3
+	G92         Point // G92 offset added to a position to get the work coordinate
+	G92Saved    Point // offset suspended by G92.2
+}
+
+func NewState() State {
+	return State{Motion: Rapid, Spindle: SpindleOff, Units: Millimetres, Distance: Absolute, Plane: PlaneXY, WCS: 1}
+}
+
+// Applies the words of the block to the state.
+func (s *State) Update(b *Block) {
+	var offset *CodeCmd
+	change := false // M6
+	for i, cmd := range b.Cmds {
+		switch cmd.Cmd {
+		case "G":
+			{
+				switch cmd.Value {
+				case 0:
+					s.Motion = Rapid
+				case 1:
+					s.Motion = Linear
+				case 2:
+					s.Motion = ArcCW
+				case 3:
+					s.Motion = ArcCCW
+				case 17:
+					s.Plane = PlaneXY
+				case 18:
+					s.Plane = PlaneZX
+				case 19:
+					s.Plane = PlaneYZ
+				case 20:
+					s.Units = Inches
+				case 21:
+					s.Units = Millimetres
+				case 28, 30:
+					s.home(b)
+				case 90:
+					s.Distance = Absolute
+				case 90.1:
+					s.ArcIJK = true
+				case 91:
+					s.Distance = Incremental
+				case 91.1:
+					s.ArcIJK = false
+				case 93:
+					s.InverseTime = true
+				case 94:
+					s.InverseTime = false
+				case 54, 55, 56, 57, 58, 59:
+					s.setWCS(int(cmd.Value) - 53)
+				case 59.1, 59.2, 59.3:
+					s.setWCS(int(math.Round(cmd.Value*10)) - 584)
+				case 92, 92.1, 92.2, 92.3:
+					offset = &b.Cmds[i]
+				}
+			}
+		case "M":
+			{
+				switch cmd.Value {
+				case 3:
+					s.Spindle = SpindleCW
+				case 4:
+					s.Spindle = SpindleCCW
+				case 5:
+					s.Spindle = SpindleOff
+				case 6:
+					change = true
+				case 7:
+					s.Mist = true
+				case 8:
+					s.Flood = true
+				case 9:
+					s.Mist = false
+					s.Flood = false
+				}
+			}
+		case "F":
+			s.Feed = cmd.Value
+		case "S":
+			s.Speed = cmd.Value
+		case "T":
+			s.NextTool = int(cmd.Value)
+		}
+	}
+
+	if change { // after T, which is selected first wherever it is in the block
+		s.Tool = s.NextTool
+	}
+	if offset != nil {
+		s.applyG92(offset.Value, b)
+	}
+	if b.AxisCmd != nil && b.AxisCmd.Type == Opaque {
+		s.unsupported(b)
+	}
+
+	// an incremental move from an unknown position is taken from zero
+	if b.X != nil {
+		s.Position.X = s.axis(s.Position.X, b.X.Value)
+		s.KnownX = true
+	}
+	if b.Y != nil {
+		s.Position.Y = s.axis(s.Position.Y, b.Y.Value)
+		s.KnownY = true
+	}
+	if b.Z != nil {
+		s.Position.Z = s.axis(s.Position.Z, b.Z.Value)
+		s.KnownZ = true
+	}
+	for _, axis := range AuxiliaryAxes {
+		if word := *b.auxiliary(axis); word != nil {
+			position := s.Aux.field(axis)
+			*position = s.axis(*position, word.Value)
+		}
+	}
+}
+
+func (s *State) axis(position float64, value float64) float64 {
+	if s.Distance == Incremental {
+		return position + value
+	}
+	return value
+}
+
+// G28/G30 move the axes named in the block, or all axes if none are named, through the
+// intermediate point to a home position stored in the machine, so the axes become unknown.
+// The intermediate point is a move in the work coordinates, Reposition moves it with the data.
+func (s *State) home(b *Block) {
+	var x, y, z, named bool
+	for _, cmd := range b.Cmds {
+		named = named || isAxis(cmd.Cmd)
+		switch cmd.Cmd {
+		case "X":
+			x = true
+		case "Y":
+			y = true
+		case "Z":
+			z = true
+		}
+	}
+	if !named {
+		x, y, z = true, true, true
+	}
+	s.KnownX = s.KnownX && !x
+	s.KnownY = s.KnownY && !y
+	s.KnownZ = s.KnownZ && !z
+}
+
+// An unsupported code may move the axes named in the block or change their offsets, so they become unknown.
+func (s *State) unsupported(b *Block) {
+	for _, cmd := range b.Cmds {
+		switch cmd.Cmd {
+		case "X":
+			s.KnownX = false
+		case "Y":
+			s.KnownY = false
+		case "Z":
+			s.KnownZ = false
+		}
+	}
+}
+
+// Selecting another coordinate system makes the position unknown as its offsets are not known.
+func (s *State) setWCS(wcs int) {
+	if wcs == s.WCS {
+		return
+	}
+	s.WCS = wcs
+	s.KnownX = false
+	s.KnownY = false
+	s.KnownZ = false
+}
+
+// G92 makes the current position have the coordinates of the axis words, G92.1 clears the offset,
+// G92.2 suspends and G92.3 restores it.
+func (s *State) applyG92(code float64, b *Block) {
+	base := s.Base()
+	switch code {
+	case 92:
+		for _, cmd := range b.Cmds {
+			switch cmd.Cmd {
+			case "X":
+				s.G92.X = base.X - cmd.Value
+				s.KnownX = true
+			case "Y":
+				s.G92.Y = base.Y - cmd.Value
+				s.KnownY = true
+			case "Z":
+				s.G92.Z = base.Z - cmd.Value
+				s.KnownZ = true
+			case "A", "B", "C", "U", "V", "W": // offsets of these axes are not kept
+				*s.Aux.field(cmd.Cmd) = cmd.Value
+			}
+		}
+		s.G92Saved = Point{}
+	case 92.1:
+		s.G92 = Point{}
+		s.G92Saved = Point{}
+	case 92.2:
+		s.G92Saved = s.G92
+		s.G92 = Point{}
+	case 92.3:
+		s.G92 = s.G92Saved
+	}
+	s.Position = Point{X: base.X - s.G92.X, Y: base.Y - s.G92.Y, Z: base.Z - s.G92.Z}
+}
+
+// Returns the position in the work coordinate system without the G92 offset.
+func (s *State) Base() Point {
+	return Point{X: s.Position.X + s.G92.X, Y: s.Position.Y + s.G92.Y, Z: s.Position.Z + s.G92.Z}
+}
+
+func (s *State) IsArc() bool {
+	return s.Motion == ArcCW || s.Motion == ArcCCW
+}
+
+// Default tolerance of positions compared as the same, in the units of the program.
+const DefaultTolerance = 0.000001
+
+// True if the values differ by no more than tolerance.
+func Near(a float64, b float64, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+// True if all the axes are within tolerance of those of o.
+func (a *Auxiliary) Near(o *Auxiliary, tolerance float64) bool {
+	for _, axis := range AuxiliaryAxes {
+		if !Near(a.Get(axis), o.Get(axis), tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// True if both states know the axis and it has the same position within tolerance.
+func (s *State) SameX(o *State, tolerance float64) bool {
+	return s.KnownX && o.KnownX && Near(s.Position.X, o.Position.X, tolerance)
+}
+
+func (s *State) SameY(o *State, tolerance float64) bool {
+	return s.KnownY && o.KnownY && Near(s.Position.Y, o.Position.Y, tolerance)
+}
+
+func (s *State) SameZ(o *State, tolerance float64) bool {
+	return s.KnownZ && o.KnownZ && Near(s.Position.Z, o.Position.Z, tolerance)
+}
+
+// Limit in radians on the angle between a move and the scan direction for it to be along the scan lines,
+// so that the rounding of the positions of angled rasters is allowed for.
+const ScanAngleTolerance = 0.001
+
+// True if both states know X and Y and the XY move from o is along the unit direction, off the line
+// by no more than tolerance and ScanAngleTolerance of its length.
+func (s *State) AlongScan(o *State, direction Point, tolerance float64) bool {
+	if !s.KnownX || !o.KnownX || !s.KnownY || !o.KnownY {
+		return false
+	}
+	dx := s.Position.X - o.Position.X
+	dy := s.Position.Y - o.Position.Y
+	off := math.Abs(dx*direction.Y - dy*direction.X)
+	return off <= tolerance+ScanAngleTolerance*math.Hypot(dx, dy)
+}
+
+// Resolves the state of every block from the default state and returns the final state.
+func (bs Blocks) Resolve() State {
+	return bs.ResolveFrom(NewState())
+}
+
+// Resolves the state of every block starting from state and returns the final state.
+func (bs Blocks) ResolveFrom(state State) State {
+	for _, block := range bs {
+		block.Start = state.Position
+		state.Update(block)
+		block.State = state
+	}
+	return state
 }
@@ -0,0 +1,346 @@
+package gcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{
+		"%",
+		"G20 G90",
+		"G00 X1 Y2 S20000 M3",
+		"G01 Z-1 F250",
+		"X3",
+		"G02 X4 Y3 I1 J0",
+		"Y4 I0 J1",
+		"M5",
+		"G21",
+	}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	final := blocks.Resolve()
+
+	t.Run("Initial", func(t *testing.T) {
+		s := blocks[0].State
+		assert.False(s.KnownX)
+		assert.EqualValues(Rapid, s.Motion)
+		assert.EqualValues(Millimetres, s.Units)
+		assert.EqualValues(SpindleOff, s.Spindle)
+	})
+
+	t.Run("Units", func(t *testing.T) {
+		assert.EqualValues(Inches, blocks[1].State.Units)
+		assert.EqualValues(Absolute, blocks[1].State.Distance)
+		assert.EqualValues(Millimetres, final.Units)
+	})
+
+	t.Run("Position", func(t *testing.T) {
+		s := blocks[2].State
+		assert.True(s.KnownX)
+		assert.True(s.KnownY)
+		assert.False(s.KnownZ)
+		assert.EqualValues(Point{X: 1, Y: 2, Z: 0}, s.Position)
+		assert.EqualValues(SpindleCW, s.Spindle)
+		assert.EqualValues(20000, s.Speed)
+
+		s = blocks[4].State
+		assert.EqualValues(Point{X: 3, Y: 2, Z: -1}, s.Position)
+		assert.EqualValues(Point{X: 1, Y: 2, Z: -1}, blocks[4].Start)
+		assert.EqualValues(Linear, s.Motion, "modal G1")
+		assert.EqualValues(250, s.Feed, "modal F")
+		assert.False(blocks[4].IsArc())
+	})
+
+	t.Run("Modal arc", func(t *testing.T) {
+		assert.True(blocks[5].IsArc())
+		assert.True(blocks[6].IsArc(), "arc continued without G")
+		assert.False(blocks[7].IsArc(), "no move")
+		arc, err := blocks[6].Arc(blocks[6].Start)
+		require.Empty(t, err)
+		assert.True(arc.Clockwise)
+		assert.EqualValues(Point{X: 4, Y: 4, Z: -1}, blocks[6].State.Position)
+		assert.EqualValues(SpindleOff, blocks[7].State.Spindle)
+	})
+
+	t.Run("Same", func(t *testing.T) {
+		assert.False(blocks[2].State.SameZ(&blocks[3].State, DefaultTolerance), "unknown Z")
+		assert.True(blocks[3].State.SameY(&blocks[4].State, DefaultTolerance))
+		assert.False(blocks[3].State.SameX(&blocks[4].State, DefaultTolerance))
+	})
+
+	t.Run("Tool change", func(t *testing.T) {
+		for _, line := range []string{"T2 M6", "M6 T2"} {
+			b, err := ParseLine(line)
+			require.NoError(t, err)
+			s := State{Tool: 1, NextTool: 1}
+			s.Update(b)
+			assert.EqualValues(2, s.Tool, "%s loads the selected tool", line)
+		}
+	})
+}
+
+func TestStateIncremental(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{
+		"G91",
+		"G00 X1 Y2 Z5",
+		"G01 Z-6",
+		"X3",
+		"G90.1 G03 X-4 Y0 I2 J2",
+		"G91.1 G90 X10",
+	}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	blocks.Resolve()
+
+	assert.EqualValues(Incremental, blocks[0].State.Distance)
+	assert.EqualValues(Point{X: 1, Y: 2, Z: 5}, blocks[1].State.Position)
+	assert.EqualValues(Point{X: 1, Y: 2, Z: -1}, blocks[2].State.Position)
+	assert.EqualValues(Point{X: 4, Y: 2, Z: -1}, blocks[3].State.Position)
+	assert.EqualValues(Point{X: 0, Y: 2, Z: -1}, blocks[4].State.Position)
+	assert.True(blocks[4].State.ArcIJK)
+	assert.EqualValues(Point{X: 10, Y: 2, Z: -1}, blocks[5].State.Position)
+	assert.EqualValues(Absolute, blocks[5].State.Distance)
+	assert.False(blocks[5].State.ArcIJK)
+
+	arc, err := blocks[4].Arc(blocks[4].Start)
+	require.Empty(t, err)
+	assert.EqualValues(2, arc.Center.X, "absolute center")
+	assert.EqualValues(2, arc.Center.Y, "absolute center")
+	assert.InDelta(2, arc.Radius, 1e-5)
+
+	t.Run("ToAbsolute", func(t *testing.T) {
+		abs := blocks.ToAbsolute()
+		assert.EqualValues("G90", abs[0].String(false, false))
+		assert.EqualValues("G00X1Y2Z5", abs[1].String(false, false))
+		assert.EqualValues("G01Z-1", abs[2].String(false, false))
+		assert.EqualValues("X4", abs[3].String(false, false))
+		assert.EqualValues("G90.1G03X0Y2I2J2", abs[4].String(false, false))
+		assert.EqualValues("G91 ", blocks[0].String(false, true), "original unchanged")
+
+		abs.Resolve()
+		for i := range abs {
+			assert.EqualValues(blocks[i].State.Position, abs[i].State.Position)
+		}
+	})
+
+	t.Run("Reposition", func(t *testing.T) {
+		b := blocks[3].Copy()
+		b.Reposition(1, 1)
+		assert.EqualValues(3, b.X.Value, "incremental word unchanged")
+		assert.EqualValues(Point{X: 5, Y: 3, Z: -1}, b.State.Position)
+
+		b = blocks[4].Copy()
+		b.Reposition(1, 1)
+		assert.EqualValues(3, b.I.Value, "absolute center moved")
+		assert.EqualValues(3, b.J.Value, "absolute center moved")
+	})
+}
+
+func TestStateOffsets(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{
+		"G54",
+		"G0 X10 Y10 Z5",
+		"G92 X0 Y0",
+		"G1 X5",
+		"G92.2",
+		"G92.3",
+		"G92.1",
+		"G55",
+		"G59.2",
+	}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	blocks.Resolve()
+
+	assert.EqualValues(1, blocks[0].State.WCS)
+	assert.Empty(blocks[2].X, "G92 words are not a move")
+	assert.False(blocks[2].IsMove())
+	assert.NotEmpty(blocks[2].AxisCmd)
+	assert.EqualValues(Point{X: 0, Y: 0, Z: 5}, blocks[2].State.Position)
+	assert.EqualValues(Point{X: 10, Y: 10, Z: 0}, blocks[2].State.G92)
+	assert.EqualValues(Point{X: 5, Y: 0, Z: 5}, blocks[3].State.Position)
+	assert.EqualValues(Point{X: 15, Y: 10, Z: 5}, blocks[3].State.Base())
+	assert.EqualValues(Point{X: 15, Y: 10, Z: 5}, blocks[4].State.Position, "G92.2 suspended")
+	assert.EqualValues(Point{X: 5, Y: 0, Z: 5}, blocks[5].State.Position, "G92.3 restored")
+	assert.EqualValues(Point{X: 15, Y: 10, Z: 5}, blocks[6].State.Position, "G92.1 cleared")
+	assert.EqualValues(Point{}, blocks[6].State.G92)
+
+	assert.EqualValues(2, blocks[7].State.WCS)
+	assert.False(blocks[7].State.KnownX, "position unknown in new coordinate system")
+	assert.EqualValues(8, blocks[8].State.WCS)
+
+	t.Run("Info", func(t *testing.T) {
+		blocks := make(Blocks, 0)
+		for _, line := range []string{"G0 X10 Y10 Z5", "G92 Z10", "G1 Z8", "G1 X20 Z4", "G0 Z15"} {
+			b, _ := ParseLine(line)
+			blocks = append(blocks, b)
+		}
+		info := FindInfo(&blocks)
+		assert.EqualValues(-1, info.Z.Min, "Z in the frame of the start")
+		assert.EqualValues(10, info.Z.Max)
+		assert.EqualValues(20, info.X.Max)
+
+		info.Increment = -3
+		info.MinCut = 0.5
+		b := blocks[3].Copy()
+		b.ToStepZ(&info, 1)
+		assert.True(b.IsClamped)
+		assert.EqualValues(5.5, b.Z.Value, "clamped to 0.5 in the frame of the start")
+	})
+}
+
+func TestStateDialect(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{
+		"G17 G40 G49 G80 G94",
+		"G0 X1 Y2 Z5 M8",
+		"G4 P1.5",
+		"M7",
+		"G93 G1 Z-1 F60",
+		"M9 G94",
+		"G91 G28 Z0",
+		"G90 G28",
+		"M0",
+	}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	blocks.Resolve()
+
+	assert.True(blocks[1].State.Flood)
+	assert.False(blocks[2].HasData, "dwell")
+	assert.EqualValues(Point{X: 1, Y: 2, Z: 5}, blocks[2].State.Position)
+	assert.True(blocks[3].State.Mist)
+	assert.True(blocks[4].State.InverseTime)
+	assert.False(blocks[5].State.Mist)
+	assert.False(blocks[5].State.Flood)
+	assert.False(blocks[5].State.InverseTime)
+
+	t.Run("Home", func(t *testing.T) {
+		assert.True(blocks[6].IsHome())
+		assert.False(blocks[6].HasData, "intermediate point is not data")
+		assert.True(blocks[6].State.KnownX)
+		assert.False(blocks[6].State.KnownZ)
+		assert.False(blocks[7].State.KnownX)
+
+		c := blocks[6].Copy()
+		c.ToAbsolute()
+		assert.EqualValues("G90 G28 Z-1.000 ", c.String(false, true), "intermediate point")
+	})
+}
+
+func TestStateAuxiliary(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{"G0 X0 A0 Z25", "G1 Z14 U2 F300", "X10 A90", "G91 A45 W1", "G90 G92 A0", "G1 A-30", "G28 A0", "G0 Z25"}
+	blocks := make(Blocks, 0)
+	for _, line := range lines {
+		b, err := ParseLine(line)
+		require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+		blocks = append(blocks, b)
+	}
+	_, err := ParseLine("G1 A1 A2")
+	assert.NotEmpty(err, "multiple A")
+
+	info := FindInfo(&blocks)
+	assert.True(blocks[2].IsAuxiliaryMove())
+	assert.True(blocks[2].IsMove())
+	assert.EqualValues(Auxiliary{A: 90, U: 2}, blocks[2].State.Aux)
+	assert.EqualValues(Auxiliary{A: 135, U: 2, W: 1}, blocks[3].State.Aux, "incremental")
+	assert.False(blocks[4].HasData, "G92 A is not a move")
+	assert.EqualValues(0, blocks[4].State.Aux.A)
+	assert.True(blocks[6].State.KnownZ, "G28 A only homes A")
+
+	assert.True(info.IsRotary())
+	assert.EqualValues(-30, info.A.Min)
+	assert.EqualValues(135, info.A.Max)
+	assert.EqualValues(2, info.U.Max)
+	assert.False(info.B.IsSet())
+
+	abs := blocks.ToAbsolute()
+	assert.EqualValues("G90A135W1", abs[3].String(false, false))
+
+	info.Increment = -3
+	info.Top = 20
+	assert.EqualValues(2, info.Passes(), "steps from the radius")
+
+	inches := blocks.ConvertUnits(Inches)
+	assert.EqualValues("G01 Z0.5512 U0.0787 F11.8110", strings.TrimSpace(inches[2].String(false, true)))
+	assert.EqualValues("X0.3937 A90.0000", strings.TrimSpace(inches[3].String(false, true)), "degrees unchanged")
+}
+
+func TestStateTolerance(t *testing.T) {
+	assert := assert.New(t)
+
+	top, depth := 0.2, 0.3 // summed at run time, not folded as constants
+	a := State{KnownX: true, KnownZ: true, Position: Point{X: 1000.0001, Z: -0.1}}
+	b := State{KnownX: true, KnownZ: true, Position: Point{X: 1000.0001 + 1e-9, Z: top - depth}}
+	require.NotEqual(t, a.Position.Z, b.Position.Z)
+	assert.True(a.SameX(&b, DefaultTolerance))
+	assert.True(a.SameZ(&b, DefaultTolerance), "rounding of the sum")
+	assert.False(a.SameX(&b, 0))
+	b.Position.X = 1000.0002
+	assert.False(a.SameX(&b, DefaultTolerance), "micron steps are kept at large X")
+
+	a.Aux.A = 90
+	b.Aux.A = 90.0000001
+	assert.True(a.Aux.Near(&b.Aux, DefaultTolerance))
+	assert.False(a.Aux.Near(&b.Aux, 0))
+}
+
+func TestStateAlongScan(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		direction Point
+		to        Point
+		along     bool
+	}{
+		"X":            {direction: Point{X: 1}, to: Point{X: 5}, along: true},
+		"X backwards":  {direction: Point{X: 1}, to: Point{X: -5}, along: true},
+		"X step":       {direction: Point{X: 1}, to: Point{Y: 1}},
+		"Y":            {direction: Point{Y: 1}, to: Point{Y: 5}, along: true},
+		"Y step":       {direction: Point{Y: 1}, to: Point{X: 0.5, Y: 5}},
+		"Diagonal":     {direction: Point{X: 0.6, Y: 0.8}, to: Point{X: 3, Y: 4}, along: true},
+		"Rounded":      {direction: Point{X: 0.6, Y: 0.8}, to: Point{X: 30.001, Y: 40}, along: true},
+		"Off diagonal": {direction: Point{X: 0.6, Y: 0.8}, to: Point{X: 3.1, Y: 4}},
+		"Z only":       {direction: Point{X: 1}, to: Point{Z: -1}, along: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			from := State{KnownX: true, KnownY: true}
+			to := State{KnownX: true, KnownY: true, Position: tc.to}
+			assert.EqualValues(tc.along, to.AlongScan(&from, tc.direction, DefaultTolerance))
+		})
+	}
+
+	assert.False((&State{KnownX: true}).AlongScan(&State{KnownX: true}, Point{X: 1}, DefaultTolerance), "Y unknown")
+}
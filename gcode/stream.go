@@ -0,0 +1,178 @@
+// stream
+package gcode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Stream reads a program from a seekable input without holding its blocks, the input is read
+// again for each range of blocks that is needed. The whole program is one segment.
+type Stream struct {
+	Info         Info // Setup, Data and Finish are left empty
+	Unrecognised map[string]int
+	ParseErrors  []*ParseError
+	Incremental  bool // the data uses incremental distances, so it is converted to absolute
+	Lenient      bool
+	input        io.ReadSeeker
+	first        int // index of the first data block
+	last         int // index of the last data block
+	count        int // number of blocks
+}
+
+// Iterator yields the resolved blocks of a range of a stream one at a time.
+type Iterator struct {
+	reader   *Reader
+	index    int // of the next block
+	end      int // index after the range
+	absolute bool
+	ignored  []*ParseError // lines that fail to parse are reported by the scan of the stream
+}
+
+// Scans the input for the range of the data and its info. Lines that fail to parse are
+// collected in ParseErrors and left out, the error is only set if reading the input fails
+// or the program cannot be streamed. Expanding needs the whole program, so it is not streamed.
+func NewStream(input io.ReadSeeker, lenient bool) (*Stream, error) {
+	s := &Stream{Lenient: lenient, input: input, first: math.MaxInt, last: -1}
+	s.Info.Init()
+	reader, err := s.rewind()
+	if err != nil {
+		return nil, err
+	}
+	s.ParseErrors = make([]*ParseError, 0)
+	previous := NewState()
+	changeLine := 0 // of the last tool change
+	for {
+		block, err := readParsed(reader, &s.ParseErrors)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block.mCode(98) != nil || block.cycle() != nil {
+			return nil, fmt.Errorf("line %d: subprogram calls and canned cycles cannot be streamed", block.Line)
+		}
+		if block.IsToolChange() {
+			changeLine = block.Line
+		}
+		if block.HasData && s.first != math.MaxInt && block.State.Tool != s.Info.Tool { // one segment
+			return nil, fmt.Errorf("line %d: tool changes in the data cannot be streamed", changeLine)
+		}
+		if block.HasData {
+			if s.first == math.MaxInt {
+				s.first = s.count
+				s.Info.Start = previous
+				s.Info.Units = block.State.Units
+				s.Info.Tool = block.State.Tool
+			}
+			s.last = s.count
+			s.Info.End = block.State
+			s.Incremental = s.Incremental || block.State.Distance == Incremental
+		}
+		previous = block.State
+		s.count++
+	}
+	s.Unrecognised = reader.Unrecognised
+	if s.first == math.MaxInt { // no data
+		s.first = s.count
+		s.Info.Start = previous
+		s.Info.End = previous
+		s.Info.Units = previous.Units
+		s.Info.Tool = previous.Tool
+		return s, nil
+	}
+	s.Incremental = s.Incremental || s.Info.Start.Distance == Incremental
+
+	reader, err = s.rewind() // the ranges are in the frame of the start of the data
+	if err != nil {
+		return nil, err
+	}
+	ignored := make([]*ParseError, 0) // already collected
+	for {
+		block, err := readParsed(reader, &ignored)
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Info.updateBlock(block)
+	}
+}
+
+// Returns a reader of the input from its start.
+func (s *Stream) rewind() (*Reader, error) {
+	if _, err := s.input.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := NewReader(s.input)
+	reader.Lenient = s.Lenient
+	return reader, nil
+}
+
+// Returns the next block that parses, the errors of the lines that do not are added to parseErrors.
+func readParsed(reader *Reader, parseErrors *[]*ParseError) (*Block, error) {
+	for {
+		block, err := reader.Read()
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			*parseErrors = append(*parseErrors, pe)
+			continue
+		}
+		return block, err
+	}
+}
+
+// True if the program has data blocks.
+func (s *Stream) HasData() bool {
+	return s.last >= 0
+}
+
+// Returns an iterator of the blocks before the data.
+func (s *Stream) Setup() (*Iterator, error) {
+	return s.iterate(0, s.first, false)
+}
+
+// Returns an iterator of the data blocks, converted to absolute distances if Incremental.
+func (s *Stream) Data() (*Iterator, error) {
+	return s.iterate(s.first, s.last+1, s.Incremental)
+}
+
+// Returns an iterator of the blocks after the data.
+func (s *Stream) Finish() (*Iterator, error) {
+	return s.iterate(s.last+1, s.count, false)
+}
+
+func (s *Stream) iterate(start int, end int, absolute bool) (*Iterator, error) {
+	reader, err := s.rewind()
+	if err != nil {
+		return nil, err
+	}
+	it := &Iterator{reader: reader, end: end, absolute: absolute, ignored: make([]*ParseError, 0)}
+	for it.index < start {
+		if _, err := readParsed(reader, &it.ignored); err != nil {
+			return nil, err
+		}
+		it.index++
+	}
+	return it, nil
+}
+
+// Returns the next block of the range, io.EOF after its end.
+func (it *Iterator) Next() (*Block, error) {
+	if it.index >= it.end {
+		return nil, io.EOF
+	}
+	block, err := readParsed(it.reader, &it.ignored)
+	if err != nil {
+		return nil, err
+	}
+	it.index++
+	if it.absolute {
+		block.ToAbsolute()
+	}
+	return block, nil
+}
@@ -0,0 +1,58 @@
+package gcode
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collect(t *testing.T, open func() (*Iterator, error)) []string {
+	it, err := open()
+	require.Empty(t, err)
+	result := make([]string, 0)
+	for {
+		block, err := it.Next()
+		if err == io.EOF {
+			return result
+		}
+		require.Empty(t, err)
+		result = append(result, block.String(false, false))
+	}
+}
+
+func TestStream(t *testing.T) {
+	assert := assert.New(t)
+
+	program := "G21\nG91\n\nG0 Z5\nG1 X10 Z-7\nG1 Y5 bad\nM5\n"
+	s, err := NewStream(strings.NewReader(program), false)
+	require.Empty(t, err)
+	require.EqualValues(t, 1, len(s.ParseErrors))
+	assert.EqualValues(6, s.ParseErrors[0].Line)
+	assert.True(s.HasData())
+	assert.True(s.Incremental)
+	assert.EqualValues(MinMax{Min: -2, Max: 5}, s.Info.Z)
+	assert.EqualValues(MinMax{Min: 10, Max: 10}, s.Info.X, "X is not known before")
+	assert.EqualValues(Incremental, s.Info.Start.Distance)
+
+	assert.EqualValues([]string{"G21", "G91"}, collect(t, s.Setup))
+	assert.EqualValues([]string{"G0Z5", "G1X10Z-2"}, collect(t, s.Data), "converted to absolute")
+	assert.EqualValues([]string{"G0Z5", "G1X10Z-2"}, collect(t, s.Data), "replayed")
+	assert.EqualValues([]string{"M5"}, collect(t, s.Finish))
+
+	s, err = NewStream(strings.NewReader("G21\nM5\n"), false)
+	require.Empty(t, err)
+	assert.False(s.HasData())
+	assert.EqualValues([]string{"G21", "M5"}, collect(t, s.Setup))
+
+	_, err = NewStream(strings.NewReader("G0 Z5\nG81 X1 Y1 Z-1 R1\n"), false)
+	assert.ErrorContains(err, "line 2")
+
+	_, err = NewStream(strings.NewReader("T1 M6\nG0 Z5\nG1 Z-1\nT2 M6\nG1 Z-2\nM5\n"), false)
+	assert.ErrorContains(err, "line 4", "tool change in the data")
+	_, err = NewStream(strings.NewReader("T1 M6\nG0 Z5\nG1 Z-1\nM5\nT2 M6\nM30\n"), false)
+	assert.NoError(err, "tool change after the data")
+}
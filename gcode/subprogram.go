@@ -0,0 +1,147 @@
+// subprogram
+package gcode
+
+import (
+	"fmt"
+)
+
+// Limit on subprograms calling subprograms.
+const MaxSubprogramDepth = 10
+
+// Returns the program number if the block starts with an O word, -1 otherwise.
+func (b *Block) ProgramNumber() int {
+	if len(b.Cmds) > 0 && b.Cmds[0].Cmd == "O" {
+		return int(b.Cmds[0].Value)
+	}
+	return -1
+}
+
+// Returns the M word with the code, nil if the block has none.
+func (b *Block) mCode(code float64) *CodeCmd {
+	for i, cmd := range b.Cmds {
+		if cmd.Cmd == "M" && cmd.Value == code {
+			return &b.Cmds[i]
+		}
+	}
+	return nil
+}
+
+// Returns the first word of the block with the letter, nil if it has none.
+func (b *Block) word(letter string) *CodeCmd {
+	for i, cmd := range b.Cmds {
+		if cmd.Cmd == letter {
+			return &b.Cmds[i]
+		}
+	}
+	return nil
+}
+
+// True if any block calls a subprogram with M98.
+func (bs Blocks) HasSubprogramCalls() bool {
+	for _, block := range bs {
+		if block.mCode(98) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type subprograms struct {
+	blocks Blocks
+	starts map[int]int // index of the O block of each subprogram
+	ends   map[int]int // index of the M99 block of each subprogram
+	calls  int
+}
+
+// Returns the blocks with the M98 calls of subprograms in the same file replaced by copies of
+// the subprogram bodies, repeated by L, or by the leading digits of a Fanuc P with more than four digits.
+// A subprogram starts with an O word block and ends with M99 before the next O word block,
+// an O block that is not ended that way is a program header and kept. Subprogram bodies are left out.
+func (bs Blocks) ExpandSubprograms() (Blocks, int, error) {
+	s := subprograms{blocks: bs, starts: make(map[int]int), ends: make(map[int]int)}
+	for i, block := range bs {
+		number := block.ProgramNumber()
+		if number < 0 {
+			continue
+		}
+		for j := i + 1; j < len(bs) && bs[j].ProgramNumber() < 0; j++ {
+			if bs[j].mCode(99) != nil {
+				s.starts[number] = i
+				s.ends[number] = j
+				break
+			}
+		}
+	}
+
+	result := make(Blocks, 0, len(bs))
+	for i := 0; i < len(bs); i++ {
+		block := bs[i]
+		if end, ok := s.ends[block.ProgramNumber()]; ok && s.starts[block.ProgramNumber()] == i {
+			i = end // a definition, not run in place
+			continue
+		}
+		var err error
+		result, err = s.run(result, block, 0)
+		if err != nil {
+			return result, s.calls, err
+		}
+	}
+	return result, s.calls, nil
+}
+
+// Adds the block to the result, expanding it if it calls a subprogram.
+func (s *subprograms) run(result Blocks, block *Block, depth int) (Blocks, error) {
+	call := block.mCode(98)
+	if call == nil {
+		c := block.Copy()
+		return append(result, &c), nil
+	}
+	fail := func(cmd *CodeCmd, reason string) error {
+		pe := newParseError(cmd, reason)
+		pe.Line = block.Line
+		return pe
+	}
+	if depth >= MaxSubprogramDepth {
+		return result, fail(call, fmt.Sprintf("Subprograms nested deeper than %d", MaxSubprogramDepth))
+	}
+	p := block.word("P")
+	if p == nil {
+		return result, fail(call, "M98 without P")
+	}
+	number := int(p.Value)
+	repeats := 1
+	if l := block.word("L"); l != nil {
+		repeats = int(l.Value)
+	} else if _, ok := s.starts[number]; !ok && number > 9999 { // Fanuc P with the repeats before four digits
+		repeats = number / 10000
+		number = number % 10000
+	}
+	start, ok := s.starts[number]
+	if !ok {
+		return result, fail(p, fmt.Sprintf("Subprogram O%d not found", number))
+	}
+
+	rest := Block{Cmds: make([]CodeCmd, 0, len(block.Cmds)), Line: block.Line} // other words of the calling block are kept
+	for _, cmd := range block.Cmds {
+		if (cmd.Cmd == "M" && cmd.Value == 98) || cmd.Cmd == "P" || cmd.Cmd == "L" {
+			continue
+		}
+		rest.Cmds = append(rest.Cmds, cmd)
+	}
+	if len(rest.Cmds) > 0 {
+		rest.Parse(false)
+		result = append(result, &rest)
+	}
+
+	s.calls++
+	for r := 0; r < repeats; r++ {
+		for _, body := range s.blocks[start+1 : s.ends[number]] {
+			var err error
+			result, err = s.run(result, body, depth+1)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package gcode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readProgram(t *testing.T, program string) Blocks {
+	blocks, parseErrors, err := NewReader(strings.NewReader(program)).ReadAll()
+	require.Empty(t, err)
+	require.Empty(t, parseErrors)
+	return blocks
+}
+
+func blockStrings(blocks Blocks) []string {
+	result := make([]string, len(blocks))
+	for i, block := range blocks {
+		result[i] = strings.TrimSpace(block.String(false, false))
+	}
+	return result
+}
+
+func TestExpandSubprograms(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		program string
+		want    []string
+		calls   int
+	}{
+		"Repeat": {
+			program: "O0001\nG0 X0\nM98 P1000 L2\nM30\nO1000\nG91 G1 Z-1\nG90\nM99\n%",
+			want:    []string{"O0001", "G0 X0", "G91 G1 Z-1", "G90", "G91 G1 Z-1", "G90", "M30", "%"},
+			calls:   1,
+		},
+		"Fanuc repeat": {
+			program: "M98 P31000\nM30\nO1000\nG1 X1\nM99",
+			want:    []string{"G1 X1", "G1 X1", "G1 X1", "M30"},
+			calls:   1,
+		},
+		"Nested": {
+			program: "G0 X1 M98 P1\nM30\nO1\nM98 P2 L2\nM99\nO2\nG1 Z-1\nM99",
+			want:    []string{"G0X1", "G1 Z-1", "G1 Z-1", "M30"},
+			calls:   2,
+		},
+	}
+	for name, tc := range tests {
+		got, calls, err := readProgram(t, tc.program).ExpandSubprograms()
+		require.Empty(t, err, name)
+		assert.EqualValues(tc.want, blockStrings(got), name)
+		assert.EqualValues(tc.calls, calls, name)
+	}
+
+	got, _, err := readProgram(t, "M98 P1\nM30\nO1\nG1 X1\nM99").ExpandSubprograms()
+	require.Empty(t, err)
+	assert.EqualValues(4, got[0].Line, "source line of the body")
+
+	_, _, err = readProgram(t, "G0 X0\nM98 P7").ExpandSubprograms()
+	var pe *ParseError
+	require.True(t, errors.As(err, &pe))
+	assert.EqualValues(2, pe.Line)
+	assert.EqualValues("P7", pe.Word)
+
+	_, _, err = readProgram(t, "M98 P1\nM30\nO1\nM98 P1\nM99").ExpandSubprograms()
+	assert.ErrorContains(err, "nested deeper")
+}
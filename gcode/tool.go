@@ -0,0 +1,134 @@
+// tool
+package gcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ToolShape is the profile of the end of a cutting tool.
+type ToolShape int
+
+const (
+	FlatEnd ToolShape = iota
+	BallEnd
+	VBit
+	TaperedBall // a ball tip on a cone
+)
+
+func (ts ToolShape) String() string {
+	switch ts {
+	case BallEnd:
+		return "ball"
+	case VBit:
+		return "v"
+	case TaperedBall:
+		return "tapered"
+	}
+	return "flat"
+}
+
+// Returns the shape with the name, as returned by String.
+func ParseToolShape(name string) (ToolShape, error) {
+	for _, ts := range []ToolShape{FlatEnd, BallEnd, VBit, TaperedBall} {
+		if strings.EqualFold(name, ts.String()) {
+			return ts, nil
+		}
+	}
+	return FlatEnd, fmt.Errorf("Unknown tool shape %s", name)
+}
+
+// Tool is the geometry of the cutting end of a tool, lengths are in the units of the program.
+type Tool struct {
+	Shape       ToolShape
+	Diameter    float64
+	Angle       float64 // included angle in degrees of a V bit or the cone of a tapered ball
+	TipDiameter float64 // of the ball of a tapered ball
+}
+
+// Returns an error if the dimensions do not describe a tool of the shape.
+func (t *Tool) Validate() error {
+	if t.Diameter <= 0 {
+		return errors.New("Tool diameter must be positive")
+	}
+	if (t.Shape == VBit || t.Shape == TaperedBall) && (t.Angle <= 0 || t.Angle >= 180) {
+		return fmt.Errorf("Angle %g of a %s tool must be between 0 and 180", t.Angle, t.Shape)
+	}
+	if t.Shape == TaperedBall && (t.TipDiameter <= 0 || t.TipDiameter >= t.Diameter) {
+		return fmt.Errorf("Tip diameter %g must be positive and less than the diameter %g", t.TipDiameter, t.Diameter)
+	}
+	return nil
+}
+
+// Returns the radius of the tool.
+func (t *Tool) Radius() float64 {
+	return t.Diameter / 2
+}
+
+// Returns the height above the tip of the end of the tool at the distance r from its axis, r must not be
+// more than the radius. Above the end the sides of the tool are vertical.
+func (t *Tool) Height(r float64) float64 {
+	half := t.Angle * math.Pi / 360
+	switch t.Shape {
+	case BallEnd:
+		{
+			radius := t.Radius()
+			return radius - math.Sqrt(math.Max(radius*radius-r*r, 0))
+		}
+	case VBit:
+		{
+			return r / math.Tan(half)
+		}
+	case TaperedBall:
+		{
+			ball := t.TipDiameter / 2
+			tangent := ball * math.Cos(half) // where the cone touches the ball
+			if r <= tangent {
+				return ball - math.Sqrt(math.Max(ball*ball-r*r, 0))
+			}
+			return ball*(1-math.Sin(half)) + (r-tangent)/math.Tan(half)
+		}
+	}
+	return 0
+}
+
+// Profile is the height of the end of a shape above its tip, by the distance from its axis.
+type Profile interface {
+	Radius() float64
+	Height(r float64) float64
+}
+
+// grown is the tool enlarged by a distance in every direction, its heights are from the tip of the tool.
+type grown struct {
+	tool *Tool
+	by   float64
+}
+
+// Returns the profile of the tool enlarged by the distance in every direction, so that a surface below it
+// is at least that distance from the tool, normal to the surface.
+func (t *Tool) Grown(by float64) Profile {
+	return &grown{tool: t, by: by}
+}
+
+func (g *grown) Radius() float64 {
+	return g.tool.Radius() + g.by
+}
+
+// Returns the lowest point at the distance r of the spheres on the end of the tool.
+func (g *grown) Height(r float64) float64 {
+	if g.by <= 0 {
+		return g.tool.Height(math.Min(r, g.tool.Radius()))
+	}
+	const steps = 32
+	lowest := math.Inf(1)
+	from := math.Max(r-g.by, 0)
+	to := math.Min(r+g.by, g.tool.Radius())
+	for i := 0; i <= steps; i++ {
+		s := from + (to-from)*float64(i)/steps
+		d := r - s
+		lowest = math.Min(lowest, g.tool.Height(s)-math.Sqrt(math.Max(g.by*g.by-d*d, 0)))
+	}
+	return lowest
+}
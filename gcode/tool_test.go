@@ -0,0 +1,60 @@
+package gcode
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToolHeight(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		tool   Tool
+		r      float64
+		height float64
+	}{
+		"Flat":            {tool: Tool{Shape: FlatEnd, Diameter: 6}, r: 2, height: 0},
+		"Ball tip":        {tool: Tool{Shape: BallEnd, Diameter: 6}, r: 0, height: 0},
+		"Ball edge":       {tool: Tool{Shape: BallEnd, Diameter: 6}, r: 3, height: 3},
+		"V 90":            {tool: Tool{Shape: VBit, Diameter: 6, Angle: 90}, r: 2, height: 2},
+		"V 60":            {tool: Tool{Shape: VBit, Diameter: 6, Angle: 60}, r: 1, height: math.Sqrt(3)},
+		"Tapered ball":    {tool: Tool{Shape: TaperedBall, Diameter: 6, Angle: 90, TipDiameter: 2}, r: 0.5, height: 1 - math.Sqrt(0.75)},
+		"Tapered cone":    {tool: Tool{Shape: TaperedBall, Diameter: 6, Angle: 90, TipDiameter: 2}, r: 2, height: 1 - math.Sqrt(0.5) + 2 - math.Sqrt(0.5)},
+		"Tapered tangent": {tool: Tool{Shape: TaperedBall, Diameter: 6, Angle: 90, TipDiameter: 2}, r: math.Sqrt(0.5), height: 1 - math.Sqrt(0.5)},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(tc.tool.Validate())
+			assert.InDelta(tc.height, tc.tool.Height(tc.r), 1e-9)
+		})
+	}
+
+	assert.Error((&Tool{Shape: VBit, Diameter: 6}).Validate(), "no angle")
+	assert.Error((&Tool{Shape: TaperedBall, Diameter: 6, Angle: 30, TipDiameter: 6}).Validate(), "tip too large")
+	assert.Error((&Tool{Shape: FlatEnd}).Validate(), "no diameter")
+}
+
+func TestToolGrown(t *testing.T) {
+	assert := assert.New(t)
+
+	flat := Tool{Shape: FlatEnd, Diameter: 6}
+	g := flat.Grown(0.5)
+	assert.EqualValues(3.5, g.Radius())
+	assert.InDelta(-0.5, g.Height(0), 1e-9, "below the tip")
+	assert.InDelta(-0.5, g.Height(3), 1e-9, "under the edge")
+	assert.InDelta(0, g.Height(3.5), 1e-9, "beside the edge")
+
+	v := Tool{Shape: VBit, Diameter: 10, Angle: 90}
+	g = v.Grown(0.5)
+	assert.InDelta(-0.5, g.Height(0), 1e-9, "below the tip")
+	assert.InDelta(2-0.5*math.Sqrt2, g.Height(2), 1e-3, "normal to the flank")
+
+	shape, err := ParseToolShape("V")
+	assert.NoError(err)
+	assert.EqualValues(VBit, shape)
+	_, err = ParseToolShape("drill")
+	assert.Error(err)
+}
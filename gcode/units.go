@@ -0,0 +1,139 @@
+// units
+package gcode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const MillimetresPerInch = 25.4
+
+func (u Units) String() string {
+	if u == Inches {
+		return "in"
+	}
+	return "mm"
+}
+
+// Returns the factor to convert a length from units to units.
+func (u Units) Factor(to Units) float64 {
+	if u == to {
+		return 1
+	}
+	if to == Inches {
+		return 1 / MillimetresPerInch
+	}
+	return MillimetresPerInch
+}
+
+// G code word selecting the units.
+func (u Units) Code() float64 {
+	if u == Inches {
+		return 20
+	}
+	return 21
+}
+
+// Length is a value with optional units, e.g. "-3", "-0.1in" or "500mm/min".
+// Without units it is taken to be in the units of the program.
+type Length struct {
+	Value    float64
+	Units    Units
+	HasUnits bool
+}
+
+var lengthSuffixes = []struct {
+	suffix string
+	units  Units
+}{
+	{"mm/min", Millimetres},
+	{"in/min", Inches},
+	{"ipm", Inches},
+	{"mm", Millimetres},
+	{"in", Inches},
+	{"\"", Inches},
+}
+
+func ParseLength(text string) (Length, error) {
+	var l Length
+	str := strings.ToLower(strings.TrimSpace(text))
+	for _, s := range lengthSuffixes {
+		if strings.HasSuffix(str, s.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, s.suffix))
+			l.Units = s.units
+			l.HasUnits = true
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return l, errors.New("Invalid length " + text)
+	}
+	l.Value = v
+	return l, nil
+}
+
+func (l *Length) UnmarshalText(text []byte) error {
+	var err error
+	*l, err = ParseLength(string(text))
+	return err
+}
+
+func (l Length) String() string {
+	str := strconv.FormatFloat(l.Value, 'f', -1, 64)
+	if l.HasUnits {
+		return str + l.Units.String()
+	}
+	return str
+}
+
+// Returns the value converted to units, a value without units is returned unchanged.
+func (l Length) In(units Units) float64 {
+	if !l.HasUnits {
+		return l.Value
+	}
+	return l.Value * l.Units.Factor(units)
+}
+
+// Returns copies of the resolved blocks converted to units, lengths and feeds are scaled
+// and G20/G21 replaced. A units block is added after the leading % if the program has none.
+func (bs Blocks) ConvertUnits(units Units) Blocks {
+	result := make(Blocks, 0, len(bs)+1)
+	found := false
+	for _, block := range bs {
+		c := block.Copy()
+		factor := block.State.Units.Factor(units)
+		for i, cmd := range c.Cmds {
+			switch cmd.Cmd {
+			case "G":
+				if cmd.Value == 20 || cmd.Value == 21 {
+					c.Cmds[i].SetValue(units.Code())
+					found = true
+				}
+			case "X", "Y", "Z", "I", "J", "K", "R", "U", "V", "W": // A, B and C are degrees
+				c.Cmds[i].SetValue(c.Cmds[i].Value * factor)
+			case "F":
+				if block.State.InverseTime { // G93 feeds do not depend on units
+					continue
+				}
+				c.Cmds[i].SetValue(c.Cmds[i].Value * factor)
+				c.Cmds[i].Type = ValueFloat // converted feeds need decimals
+			}
+		}
+		c.State.Units = units
+		result = append(result, &c)
+	}
+	if !found && units != Millimetres { // the default is millimetres
+		index := 0
+		for index < len(result) && len(result[index].Cmds) > 0 && result[index].Cmds[0].Type == Percent {
+			index++
+		}
+		block := new(Block)
+		block.Init()
+		block.Cmds = append(block.Cmds, CodeCmd{Cmd: "G", Value: units.Code(), Type: Address})
+		block.State.Units = units
+		result = append(result[:index], append(Blocks{block}, result[index:]...)...)
+	}
+	return result
+}
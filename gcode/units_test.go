@@ -0,0 +1,103 @@
+package gcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLength(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]struct {
+		value    float64
+		units    Units
+		hasUnits bool
+		mm       float64
+	}{
+		"-3":         {value: -3, units: Millimetres, hasUnits: false, mm: -3},
+		"-0.1in":     {value: -0.1, units: Inches, hasUnits: true, mm: -2.54},
+		"0.5mm":      {value: 0.5, units: Millimetres, hasUnits: true, mm: 0.5},
+		"0.5 MM":     {value: 0.5, units: Millimetres, hasUnits: true, mm: 0.5},
+		"1\"":        {value: 1, units: Inches, hasUnits: true, mm: 25.4},
+		"500mm/min":  {value: 500, units: Millimetres, hasUnits: true, mm: 500},
+		"20in/min":   {value: 20, units: Inches, hasUnits: true, mm: 508},
+		"20ipm":      {value: 20, units: Inches, hasUnits: true, mm: 508},
+		"1.5e1":      {value: 15, units: Millimetres, hasUnits: false, mm: 15},
+		"+2.5in":     {value: 2.5, units: Inches, hasUnits: true, mm: 63.5},
+		"0.001 inch": {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			l, err := ParseLength(name)
+			if name == "0.001 inch" {
+				assert.NotEmpty(err, "invalid units")
+				return
+			}
+			require.Emptyf(t, err, "failed to parse '%s': %s", name, err)
+			assert.EqualValues(tc.value, l.Value)
+			assert.EqualValues(tc.units, l.Units)
+			assert.EqualValues(tc.hasUnits, l.HasUnits)
+			assert.InDelta(tc.mm, l.In(Millimetres), 1e-4)
+		})
+	}
+
+	t.Run("In", func(t *testing.T) {
+		l, _ := ParseLength("2.54mm")
+		assert.InDelta(0.1, l.In(Inches), 1e-6)
+		l, _ = ParseLength("3")
+		assert.EqualValues(3, l.In(Inches), "no units is unchanged")
+	})
+}
+
+func TestConvertUnits(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(t *testing.T, lines ...string) Blocks {
+		blocks := make(Blocks, 0)
+		for _, line := range lines {
+			b, err := ParseLine(line)
+			require.Emptyf(t, err, "failed to parse '%s': %s", line, err)
+			blocks = append(blocks, b)
+		}
+		blocks.Resolve()
+		return blocks
+	}
+
+	t.Run("To inches", func(t *testing.T) {
+		blocks := parse(t, "%", "G21", "G0 X25.4 Y-12.7 Z5.08", "G1 Z-2.54 F254", "G2 X0 Y0 I-12.7 J0", "G3 X25.4 R12.7")
+		got := blocks.ConvertUnits(Inches)
+		require.EqualValues(t, 6, len(got))
+		assert.EqualValues("G20", got[1].String(false, false))
+		assert.EqualValues("G0X1Y-0.5Z0.2", got[2].String(false, false))
+		assert.EqualValues("G1Z-0.1F10", got[3].String(false, false))
+		assert.EqualValues("G2X0Y0I-0.5J0", got[4].String(false, false))
+		assert.EqualValues("G3X1R0.5", got[5].String(false, false))
+		assert.EqualValues("G21", blocks[1].String(false, false), "original unchanged")
+	})
+
+	t.Run("To millimetres", func(t *testing.T) {
+		blocks := parse(t, "G20 G90", "G1 X1.5 F12.5")
+		got := blocks.ConvertUnits(Millimetres)
+		assert.EqualValues("G21G90", got[0].String(false, false))
+		assert.EqualValues("G1X38.1F317.5", got[1].String(false, false))
+
+		blocks = parse(t, "G20", "G1 X1 F7")
+		got = blocks.ConvertUnits(Millimetres)
+		assert.EqualValues("G1X25.4F177.8", got[1].String(false, false), "integer feed not rounded")
+	})
+
+	t.Run("No units word", func(t *testing.T) {
+		blocks := parse(t, "%", "%", "G0 X25.4")
+		got := blocks.ConvertUnits(Inches)
+		require.EqualValues(t, 4, len(got))
+		assert.EqualValues("G20", got[2].String(false, false))
+		assert.EqualValues("G0X1", got[3].String(false, false))
+
+		got = blocks.ConvertUnits(Millimetres)
+		assert.EqualValues(3, len(got), "millimetres is the default")
+	})
+}
@@ -2,20 +2,53 @@
 package main
 
 import (
+	"gincgcode/gcode"
+
 	"github.com/adrianre12/logl"
 	"github.com/alecthomas/kong"
 )
 
 type CliType struct {
-	Debug      bool    `help:"Enable debug mode."`
-	Pretty     bool    `short:"p" help:"Enable pretty print, this makes the output much larger"`
-	Increment  float32 `optional:"" short:"i" default:"-3.0" help:"Increment in depth of cut in each pass"`
-	Feed       float32 `optional:"" short:"f" help: "Feed rate override for incremental passes"`
-	MinCut     float32 `optional:"" short:"m" default:"0.5" help:"Minimum thickness to leave for Finish cut"`
-	SkipHeight float32 `optional:"" short:"s" default:"1.0" help:"Skip height for rapid movement, should be as low as possible to clear materarial"`
-	Infile     string  `arg:"" help:"Input filename"`
-	Outfile    string  `arg:"" optional:"" help:"Output filename"`
-	Align      string  `short:"a" enum:"none,corner,center" default:none help:"Realign output Gcode"`
+	Debug         bool           `help:"Enable debug mode."`
+	Pretty        bool           `short:"p" help:"Enable pretty print, this makes the output much larger"`
+	Increment     gcode.Length   `optional:"" short:"i" default:"-3.0" help:"Increment in depth of cut in each pass, e.g. -3 or -0.1in"`
+	Feed          gcode.Length   `optional:"" short:"f" help:"Feed rate override for incremental passes, e.g. 500 or 20in"`
+	Depths        []gcode.Length `sep:"," help:"Depth of each pass below the top, e.g. -4,-7,-9,-10.5. Passes after them step by the increment"`
+	DepthRatio    float64        `default:"1" help:"Multiply the step of each pass after the depths by this, below 1 the steps decrease down to the minimum cut"`
+	Even          bool           `help:"Spread the depth evenly over the passes of the increment, so that every pass steps by the same depth"`
+	EvenCap       bool           `help:"With --even, add passes so that the finish pass, which also removes the minimum cut, steps at most the increment"`
+	MinCut        gcode.Length   `optional:"" short:"m" default:"0.5" help:"Minimum thickness to leave for Finish cut"`
+	SkipHeight    gcode.Length   `optional:"" short:"s" default:"1.0" help:"Skip height for rapid movement, should be as low as possible to clear materarial"`
+	Infile        string         `arg:"" help:"Input filename"`
+	Outfile       string         `arg:"" optional:"" help:"Output filename"`
+	Align         string         `short:"a" enum:"none,corner,center" default:"none" help:"Realign output Gcode"`
+	Absolute      bool           `short:"A" help:"Normalise the whole program to absolute distances (G90)"`
+	Tolerance     gcode.Length   `optional:"" default:"0.000001" help:"Positions closer than this are the same when finding moves to skip, raise it to the rounding of the program for angled rasters"`
+	Linearize     gcode.Length   `optional:"" short:"l" default:"0" help:"Replace arcs with G01 segments deviating at most this much, e.g. 0.01 or 0.001in, 0 keeps arcs"`
+	Units         string         `short:"u" enum:"none,mm,in" default:"none" help:"Convert the program to mm or in, feeds included"`
+	Tools         []int          `short:"t" sep:"," help:"Only rough the segments of these tool numbers, e.g. 1,3. Default is all tools"`
+	ToolShape     string         `enum:"none,flat,ball,v,tapered" default:"none" help:"Shape of the tool, roughing points are then raised so that the tool leaves the minimum cut normal to the finished surface"`
+	ToolDiameter  gcode.Length   `optional:"" default:"0" help:"Diameter of the tool"`
+	ToolAngle     float64        `optional:"" default:"0" help:"Included angle in degrees of a v or tapered tool"`
+	ToolTip       gcode.Length   `optional:"" default:"0" help:"Diameter of the ball tip of a tapered tool"`
+	SurfaceCell   gcode.Length   `optional:"" default:"0" help:"Size of the cells of the map of the finished surface, 0 for a twentieth of the tool diameter"`
+	RoughDiameter gcode.Length   `optional:"" default:"0" help:"Rough the surface left by the finish tool with a flat end mill of this diameter before the finish program, instead of repeating the finish path. Needs --tool-shape"`
+	RoughStepover gcode.Length   `optional:"" default:"0" help:"Stepover between the rows of the roughing, 0 for 40% of its diameter"`
+	RoughTool     int            `optional:"" default:"0" help:"Tool number of the roughing end mill, 0 to pause for a manual tool change"`
+	RestThreshold gcode.Length   `optional:"" default:"0" help:"With --rough-diameter, follow the finish path in passes where the stock left by the roughing is thicker than this, 0 for none"`
+	Entry         string         `enum:"plunge,ramp,helix" default:"plunge" help:"How passes enter the stock from the skip height, ramp runs back and forth along the next cut and helix circles down, both plunge where there is no room. The roughing of --rough-diameter ramps or plunges"`
+	EntryAngle    float64        `optional:"" default:"3" help:"Steepest descent in degrees of ramp and helix entries"`
+	HelixDiameter gcode.Length   `optional:"" default:"0" help:"Diameter of helix entries, 0 for the --tool-diameter"`
+	EntryFeed     gcode.Length   `optional:"" default:"0" help:"Feed rate of entries, 0 for the feed of the cuts"`
+	Radius        gcode.Length   `optional:"" short:"r" default:"0" help:"Stock radius of jobs wrapped around a rotary axis, passes step down from it instead of Z0"`
+	Lenient       bool           `short:"L" help:"Pass unknown words through unchanged instead of failing"`
+	Expand        bool           `short:"x" help:"Evaluate LinuxCNC parameters, expressions and O-word subroutines, loops and conditions"`
+	SourceLines   bool           `help:"Add the source line number of each block as a comment"`
+	Renumber      bool           `help:"Number the output lines with N words, replacing those of the source"`
+	NumberStart   int            `default:"10" help:"First line number when renumbering"`
+	NumberStep    int            `default:"10" help:"Step between line numbers when renumbering"`
+	Checksum      bool           `help:"End each output line with a *checksum for serial protocols"`
+	Stream        bool           `help:"Read the input again for each pass instead of holding it in memory, for very large programs with one tool. Not with --expand"`
 }
 
 func main() {
@@ -0,0 +1,128 @@
+// stream
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gincgcode/gcode"
+	"io"
+	"os"
+
+	"github.com/adrianre12/logl"
+)
+
+// Roughs the input reading it again for each pass, so only the blocks of a pass are held at a time.
+// The whole program is roughed as one segment.
+func RunStream(cli *CliType, writer *bufio.Writer) error {
+	if cli.Linearize.Value > 0 || cli.Absolute || cli.Units != "none" || cli.Align != "none" || len(cli.Tools) > 0 || cli.Expand {
+		logl.Fatal("--linearize, --absolute, --units, --align, --tools and --expand cannot be used with --stream")
+	}
+	if cli.Feed.Value <= 0 {
+		logl.Fatal("Feed cannot be zero or negative")
+	}
+	fileIn, err := os.Open(cli.Infile)
+	if err != nil {
+		logl.Fatalf("Failed to open file: %s", err)
+	}
+	defer fileIn.Close()
+
+	stream, err := gcode.NewStream(fileIn, cli.Lenient)
+	if err != nil {
+		logl.Fatalf("Failed to read file: %s", err)
+	}
+	ReportParse(stream.Unrecognised, stream.ParseErrors)
+	info := &stream.Info
+	SetParameters(info, cli)
+
+	OutputIterator(writer, stream.Setup, info)
+	if !stream.HasData() {
+		logl.Info("No data to rough")
+		return nil
+	}
+	if stream.Incremental {
+		logl.Info("Converting incremental data to absolute")
+		if info.Start.Distance == gcode.Incremental {
+			writer.WriteString("G90\n")
+		}
+	}
+	LogInfo(info)
+	MapSurface(info, cli, iterate(stream.Data))
+	if cli.RoughDiameter.Value > 0 && RoughSurface(writer, info, cli) {
+		RestPasses(writer, info, func() func() *gcode.Block {
+			return splitData(stream, info)
+		})
+		writer.WriteString(";Finish\n")
+		OutputIterator(writer, stream.Data, info)
+		finishStream(writer, stream, info)
+		return nil
+	}
+
+	passes := info.Passes()
+	LogPasses(info, passes)
+	for pass := 1; pass <= passes; pass++ {
+		logl.Debugf("======================== Pass %d =============================", pass)
+		writer.WriteString(fmt.Sprintf(";Pass %d depth %.3f\n", pass, info.PassDepth(pass)))
+		if pass == passes { //last pass finish cut
+			OutputIterator(writer, stream.Data, info)
+			continue
+		}
+
+		ProcessPass(writer, info, pass, splitData(stream, info))
+	}
+
+	finishStream(writer, stream, info)
+	return nil
+}
+
+// Writes the blocks after the data, back in incremental distances if the data ended in them.
+func finishStream(writer *bufio.Writer, stream *gcode.Stream, info *gcode.Info) {
+	if stream.Incremental && info.End.Distance == gcode.Incremental {
+		writer.WriteString("G91\n")
+	}
+	OutputIterator(writer, stream.Finish, info)
+	logl.Info("Finished")
+}
+
+// Returns a function returning the data blocks one at a time with helical arcs split, nil after the last one.
+func splitData(stream *gcode.Stream, info *gcode.Info) func() *gcode.Block {
+	data := iterate(stream.Data)
+	pending := make(gcode.Blocks, 0)
+	return func() *gcode.Block {
+		for len(pending) == 0 {
+			block := data()
+			if block == nil {
+				return nil
+			}
+			pending = gcode.Blocks{block}.SplitHelices(info).SplitAlongSurface(info) // helical arcs and moves beside the surface are clamped in pieces
+		}
+		block := pending[0]
+		pending = pending[1:]
+		return block
+	}
+}
+
+// Returns a function returning the blocks of the iterator one at a time, nil after the last one.
+func iterate(open func() (*gcode.Iterator, error)) func() *gcode.Block {
+	it, err := open()
+	if err != nil {
+		logl.Fatalf("Failed to read file: %s", err)
+	}
+	return func() *gcode.Block {
+		block, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logl.Fatalf("Failed to read file: %s", err)
+		}
+		return block
+	}
+}
+
+// Writes the blocks of the iterator.
+func OutputIterator(writer *bufio.Writer, open func() (*gcode.Iterator, error), info *gcode.Info) {
+	next := iterate(open)
+	for block := next(); block != nil; block = next() {
+		OutputBlock(writer, block, info)
+	}
+}